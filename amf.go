@@ -4,9 +4,93 @@
 
 package amf
 
+import (
+	"encoding"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
 //Anything in amf
 type AMFAny interface{}
 
+// Tuple wraps a struct, or a pointer to one, so that it is encoded as a
+// dense array of its fields in declaration order instead of as an object.
+type Tuple struct {
+	V AMFAny
+}
+
+// Decimal is a fixed-point amount in hundredths, e.g. cents. It is carried
+// as an amf double and rounded half away from zero when decoded.
+type Decimal int64
+
+// RawMessage holds the encoding of a single amf value. Decoding into a
+// RawMessage records the bytes of the next value as read; encoding one
+// writes them back unchanged, or null if it is empty, and enters the
+// strings, objects and traits they introduce into the encoder's reference
+// tables. The bytes may refer to strings and objects outside the value, so
+// they are only meaningful where the reference tables line up.
+//
+// A struct field of this type tagged `amf.name:",wholeraw"` instead
+// receives the complete encoding of the enclosing object when it is
+// decoded; such a field is not encoded itself.
+type RawMessage []byte
+
+// RawAMF is another name for RawMessage, for passthrough code that
+// forwards values without interpreting them.
+type RawAMF = RawMessage
+
+var (
+	tupleType      = reflect.TypeOf(Tuple{})
+	decimalType    = reflect.TypeOf(Decimal(0))
+	urlType        = reflect.TypeOf(url.URL{})
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(RawMessage(nil))
+	bigIntType     = reflect.TypeOf(big.Int{})
+	bigFloatType   = reflect.TypeOf(big.Float{})
+	bigRatType     = reflect.TypeOf(big.Rat{})
+	hardwareType   = reflect.TypeOf(net.HardwareAddr(nil))
+	stringerType   = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+	syncMapType    = reflect.TypeOf((*sync.Map)(nil)).Elem()
+
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// tagOptions is the comma-separated list following the name in an
+// amf.name tag.
+type tagOptions string
+
+// parseTag splits an amf.name tag into the field name and its options.
+func parseTag(tag string) (string, tagOptions) {
+	if i := strings.Index(tag, ","); i >= 0 {
+		return tag[:i], tagOptions(tag[i+1:])
+	}
+	return tag, ""
+}
+
+func (o tagOptions) Contains(name string) bool {
+	for s := string(o); s != ""; {
+		var opt string
+		if i := strings.Index(s, ","); i >= 0 {
+			opt, s = s[:i], s[i+1:]
+		} else {
+			opt, s = s, ""
+		}
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
 const (
 	UNDEFINED_MARKER = 0x00
 	NULL_MARKER      = 0x01
@@ -21,4 +105,208 @@ const (
 	OBJECT_MARKER    = 0x0a
 	XML_MARKER       = 0x0b
 	BYTEARRAY_MARKER = 0x0c
+
+	VECTOR_INT_MARKER    = 0x0d
+	VECTOR_UINT_MARKER   = 0x0e
+	VECTOR_DOUBLE_MARKER = 0x0f
+	VECTOR_OBJECT_MARKER = 0x10
+	DICTIONARY_MARKER    = 0x11
+)
+
+// tupleFields returns the indexes of the fields of struct type t that take
+// part in positional (array) encoding, in declaration order.
+func tupleFields(t reflect.Type) []int {
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		if name, opts := parseTag(f.Tag.Get("amf.name")); name == "-" || opts.Contains("wholeraw") {
+			continue
+		}
+		fields = append(fields, i)
+	}
+	return fields
+}
+
+// fieldInfo describes a struct field that is encoded and decoded by name.
+type fieldInfo struct {
+	index         int
+	name          string // the tag name, or the declared name
+	lowerName     string // the tag name, or the declared name lowercased
+	exported      bool   // the declared name is not lowercase
+	preserve      bool
+	discriminator bool
+}
+
+// structInfo holds the field metadata of a struct type, computed once.
+type structInfo struct {
+	fields   []fieldInfo    // in declaration order, without - and wholeraw
+	byName   map[string]int // declared name → position in fields
+	byTag    map[string]int // tag name → position in fields
+	folded   map[string]int // folded wire name → position in fields
+	wholeRaw int            // index of the wholeraw RawMessage field, or -1
+}
+
+var structInfos sync.Map // reflect.Type → *structInfo
+
+// cachedStructInfo returns the field metadata of struct type t.
+func cachedStructInfo(t reflect.Type) *structInfo {
+	if si, ok := structInfos.Load(t); ok {
+		return si.(*structInfo)
+	}
+
+	si := &structInfo{
+		byName:   map[string]int{},
+		byTag:    map[string]int{},
+		folded:   map[string]int{},
+		wholeRaw: -1,
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts := parseTag(f.Tag.Get("amf.name"))
+		if opts.Contains("wholeraw") {
+			if si.wholeRaw < 0 && f.Type == rawMessageType {
+				si.wholeRaw = i
+			}
+			continue
+		}
+		if name == "-" {
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(f.Name)
+		fi := fieldInfo{
+			index:         i,
+			name:          name,
+			lowerName:     name,
+			exported:      !unicode.IsLower(r),
+			preserve:      opts.Contains("preserve"),
+			discriminator: opts.Contains("discriminator"),
+		}
+		pos := len(si.fields)
+		if name != "" {
+			if _, dup := si.byTag[name]; !dup {
+				si.byTag[name] = pos
+			}
+		} else {
+			fi.name = f.Name
+			fi.lowerName = string(unicode.ToLower(r)) + f.Name[size:]
+		}
+		if _, dup := si.byName[f.Name]; !dup {
+			si.byName[f.Name] = pos
+		}
+		if f.PkgPath == "" {
+			if _, dup := si.folded[foldName(fi.name)]; !dup {
+				si.folded[foldName(fi.name)] = pos
+			}
+		}
+		si.fields = append(si.fields, fi)
+	}
+
+	si2, _ := structInfos.LoadOrStore(t, si)
+	return si2.(*structInfo)
+}
+
+// foldName normalizes a member name for lenient matching: lowercased and
+// without underscores and hyphens, so "user_id" matches UserID.
+func foldName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == '-' {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, name)
+}
+
+var (
+	enumsMu sync.RWMutex
+	enums   = map[reflect.Type]func(string) (int64, bool){}
 )
+
+// RegisterEnum registers lookup to decode strings into the integer type of
+// v, for enums sent by name. Strings lookup does not resolve are parsed as
+// decimal numbers.
+func RegisterEnum(v AMFAny, lookup func(string) (int64, bool)) {
+	t := reflect.TypeOf(v)
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+	default:
+		panic("amf: RegisterEnum of non-integer type " + t.String())
+	}
+
+	enumsMu.Lock()
+	defer enumsMu.Unlock()
+	enums[t] = lookup
+}
+
+// coerceEnum resolves s through the lookup registered for t.
+func coerceEnum(t reflect.Type, s string) (int64, bool) {
+	enumsMu.RLock()
+	lookup := enums[t]
+	enumsMu.RUnlock()
+	if lookup == nil {
+		return 0, false
+	}
+	return lookup(s)
+}
+
+var (
+	typesMu   sync.RWMutex
+	typeNames = map[reflect.Type]string{}
+	nameTypes = map[string]reflect.Type{}
+	unions    []reflect.Type // registered types with a discriminator field
+)
+
+// RegisterType registers name as the discriminator of the struct type of
+// v, which may be given as a value or a pointer. When a struct is encoded,
+// a string field tagged `amf.name:",discriminator"` is filled with the
+// registered name. An object decoded into an interface whose discriminator
+// member names a registered type is decoded into a new value of that type.
+func RegisterType(name string, v AMFAny) {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		panic("amf: RegisterType of non-struct type " + t.String())
+	}
+
+	typesMu.Lock()
+	defer typesMu.Unlock()
+	typeNames[t] = name
+	nameTypes[name] = t
+	for _, f := range cachedStructInfo(t).fields {
+		if f.discriminator {
+			unions = append(unions, t)
+			break
+		}
+	}
+}
+
+// registeredName returns the discriminator registered for t, defaulting to
+// the name of the type.
+func registeredName(t reflect.Type) string {
+	typesMu.RLock()
+	defer typesMu.RUnlock()
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return t.Name()
+}
+
+// registeredType returns the type registered under name.
+func registeredType(name string) (reflect.Type, bool) {
+	typesMu.RLock()
+	defer typesMu.RUnlock()
+	t, ok := nameTypes[name]
+	return t, ok
+}
+
+// unionTypes returns the registered types that have a discriminator field.
+func unionTypes() []reflect.Type {
+	typesMu.RLock()
+	defer typesMu.RUnlock()
+	return unions
+}
@@ -0,0 +1,482 @@
+// Copyright 2011 baihaoping@gmail.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package amf
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// AMF0 markers, as used by RTMP command messages.
+const (
+	AMF0_NUMBER_MARKER       = 0x00
+	AMF0_BOOLEAN_MARKER      = 0x01
+	AMF0_STRING_MARKER       = 0x02
+	AMF0_OBJECT_MARKER       = 0x03
+	AMF0_NULL_MARKER         = 0x05
+	AMF0_UNDEFINED_MARKER    = 0x06
+	AMF0_REFERENCE_MARKER    = 0x07
+	AMF0_ECMA_ARRAY_MARKER   = 0x08
+	AMF0_OBJECT_END_MARKER   = 0x09
+	AMF0_STRICT_ARRAY_MARKER = 0x0a
+	AMF0_DATE_MARKER         = 0x0b
+	AMF0_LONG_STRING_MARKER  = 0x0c
+	AMF0_TYPED_OBJECT_MARKER = 0x10
+	AMF0_AVMPLUS_MARKER      = 0x11
+)
+
+/* ───────────────────── AMF0 entry ───────────────────── */
+
+// DecodeAMF0 decodes the next AMF0 value into v, such as an argument of an
+// RTMP connect command. Targets are filled as by Decode. A value switched
+// to AMF3 with the avmplus marker is decoded with the AMF3 tables.
+func (d *Decoder) DecodeAMF0(v AMFAny) error {
+	d.start()
+	return d.decodeAMF0(reflect.ValueOf(v))
+}
+
+func (d *Decoder) decodeAMF0(value reflect.Value) error {
+	marker, err := d.readMarker()
+	if err != nil {
+		return err
+	}
+
+	switch marker {
+	case AMF0_NULL_MARKER, AMF0_UNDEFINED_MARKER:
+		return d.decodeMarker(NULL_MARKER, value)
+	case AMF0_AVMPLUS_MARKER:
+		return d.decode(value)
+	}
+
+	/* ----- Unwrap interface / pointer ----- */
+	if value.Kind() == reflect.Interface {
+		if v := reflect.ValueOf(value.Interface()); v.Kind() == reflect.Ptr {
+			value = v
+		}
+	}
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			value.Set(reflect.New(value.Type().Elem()))
+		}
+		value = value.Elem()
+	}
+
+	/* ----- Dispatch by marker ----- */
+	switch marker {
+	case AMF0_NUMBER_MARKER:
+		n, err := d.readUint(8)
+		if err != nil {
+			return err
+		}
+		return d.setFloat(value, math.Float64frombits(n))
+	case AMF0_BOOLEAN_MARKER:
+		b, err := d.readMarker()
+		if err != nil {
+			return err
+		}
+		return d.setBool(value, b != 0)
+	case AMF0_STRING_MARKER, AMF0_LONG_STRING_MARKER:
+		size := 2
+		if marker == AMF0_LONG_STRING_MARKER {
+			size = 4
+		}
+		s, err := d.readString0(size)
+		if err != nil {
+			return err
+		}
+		return d.setString(value, s)
+	case AMF0_OBJECT_MARKER:
+		return d.readObject0(value, "")
+	case AMF0_ECMA_ARRAY_MARKER:
+		if _, err := d.readUint(4); err != nil { // approximate count
+			return err
+		}
+		return d.readObject0(value, "")
+	case AMF0_TYPED_OBJECT_MARKER:
+		class, err := d.readString0(2)
+		if err != nil {
+			return err
+		}
+		return d.readObject0(value, class)
+	case AMF0_STRICT_ARRAY_MARKER:
+		return d.readArray0(value)
+	case AMF0_DATE_MARKER:
+		n, err := d.readUint(8)
+		if err != nil {
+			return err
+		}
+		if _, err := d.readUint(2); err != nil { // timezone, the time is UTC
+			return err
+		}
+		ms := math.Float64frombits(n)
+		if math.IsNaN(ms) || math.IsInf(ms, 0) {
+			return errors.New("invalid date: " + strconv.FormatFloat(ms, 'g', -1, 64))
+		}
+		return d.setDate(value, time.UnixMilli(int64(ms)).UTC())
+	case AMF0_REFERENCE_MARKER:
+		i, err := d.readUint(2)
+		if err != nil {
+			return err
+		}
+		return d.setReference0(value, int(i))
+	default:
+		return errors.New("unsupported amf0 marker: " + strconv.Itoa(int(marker)))
+	}
+}
+
+/* ───────────────────── AMF0 compound ───────────────────── */
+
+// readObject0 decodes the members of an object, ECMA array or typed object
+// of class into value, up to the empty key and object end marker.
+func (d *Decoder) readObject0(value reflect.Value, class string) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	value, err := d.objectTarget(value, class)
+	if err != nil {
+		return err
+	}
+	switch {
+	case value.Kind() == reflect.Map:
+		if value.IsNil() {
+			m := reflect.MakeMap(value.Type())
+			value.Set(m)
+			value = m
+		}
+	case value.Kind() == reflect.Struct:
+	default:
+		return errors.New("struct expected, found: " + value.Type().String())
+	}
+	d.amf0Cache = append(d.amf0Cache, value)
+
+	for {
+		key, err := d.readString0(2)
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			end, err := d.readMarker()
+			if err != nil {
+				return err
+			}
+			if end != AMF0_OBJECT_END_MARKER {
+				return errors.New("invalid amf0 object end: " + strconv.Itoa(int(end)))
+			}
+			return nil
+		}
+
+		if value.Kind() == reflect.Map {
+			k, err := mapKey(key, value.Type().Key())
+			if err != nil {
+				return err
+			}
+			elem := d.mapElem(value, k)
+			if err := d.decodeAMF0(elem); err != nil {
+				return err
+			}
+			value.SetMapIndex(k, elem.Elem())
+			continue
+		}
+		if !utf8.ValidString(key) {
+			return errors.New("invalid utf-8 in key " + strconv.Quote(key) + " of struct " + value.Type().String())
+		}
+		f, ok := d.getField(key, value.Type())
+		if !ok {
+			if d.DisallowUnknownFields {
+				return errors.New("key " + key + " not found in struct " + value.Type().String())
+			}
+			var discard AMFAny
+			if err := d.decodeAMF0(reflect.ValueOf(&discard).Elem()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decodeAMF0(value.FieldByIndex(f.Index)); err != nil {
+			return err
+		}
+	}
+}
+
+// readArray0 decodes a strict array into a slice or interface.
+func (d *Decoder) readArray0(value reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	n, err := d.readUint(4)
+	if err != nil {
+		return err
+	}
+	if err := d.checkLen(int(n)); err != nil {
+		return err
+	}
+
+	t := value.Type()
+	switch value.Kind() {
+	case reflect.Slice:
+	case reflect.Interface:
+		t = reflect.TypeOf([]AMFAny(nil))
+	default:
+		return errors.New("invalid type: " + value.Type().String() + " for array")
+	}
+
+	// elements are appended as read, see maxPrealloc
+	v := reflect.MakeSlice(t, 0, min(int(n), maxPrealloc))
+	slot := len(d.amf0Cache)
+	d.amf0Cache = append(d.amf0Cache, v)
+	for i := 0; i < int(n); i++ {
+		elem := reflect.New(t.Elem()).Elem()
+		if err := d.decodeAMF0(elem); err != nil {
+			return err
+		}
+		v = reflect.Append(v, elem)
+	}
+	value.Set(v)
+	d.amf0Cache[slot] = v
+	return nil
+}
+
+// setReference0 sets value to the AMF0 object with index i.
+func (d *Decoder) setReference0(value reflect.Value, i int) error {
+	if i >= len(d.amf0Cache) {
+		return refRangeError("amf0 object", i, len(d.amf0Cache))
+	}
+	ref := d.amf0Cache[i]
+	if ref.Kind() == reflect.Struct && ref.CanAddr() && ref.Addr().Type().AssignableTo(value.Type()) {
+		ref = ref.Addr()
+	}
+	if !ref.Type().AssignableTo(value.Type()) {
+		return errors.New("invalid type: " + value.Type().String() + " for reference to " + ref.Type().String())
+	}
+	value.Set(ref)
+	return nil
+}
+
+/* ───────────────────── AMF0 encoding ───────────────────── */
+
+// EncodeAMF0 encodes v as AMF0, such as an RTMP command argument or the
+// onMetaData of a stream. Maps are written as ECMA arrays, slices and
+// arrays as strict arrays and structs as anonymous objects, with member
+// names as in Encode. AMF0 references are never written.
+func (e *Encoder) EncodeAMF0(v AMFAny) error {
+	return e.encodeAMF0(reflect.ValueOf(v))
+}
+
+func (e *Encoder) encodeAMF0(v reflect.Value) error {
+	if !v.IsValid() {
+		return e.writeMarker(AMF0_NULL_MARKER)
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return e.writeMarker(AMF0_NULL_MARKER)
+		}
+		return e.encodeAMF0(v.Elem())
+	case reflect.Bool:
+		if err := e.writeMarker(AMF0_BOOLEAN_MARKER); err != nil {
+			return err
+		}
+		if v.Bool() {
+			return e.writeBytes([]byte{1})
+		}
+		return e.writeBytes([]byte{0})
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.writeNumber0(float64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return e.writeNumber0(float64(v.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return e.writeNumber0(v.Float())
+	case reflect.String:
+		s := v.String()
+		if len(s) > 0xffff {
+			if err := e.writeMarker(AMF0_LONG_STRING_MARKER); err != nil {
+				return err
+			}
+			return e.writeString0(s, 4)
+		}
+		if err := e.writeMarker(AMF0_STRING_MARKER); err != nil {
+			return err
+		}
+		return e.writeString0(s, 2)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return e.writeMarker(AMF0_NULL_MARKER)
+		}
+		return e.encodeArray0(v)
+	case reflect.Map:
+		if v.IsNil() {
+			return e.writeMarker(AMF0_NULL_MARKER)
+		}
+		return e.encodeECMAArray0(v)
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return e.encodeDate0(v.Interface().(time.Time))
+		}
+		return e.encodeObject0(v)
+	}
+	return errors.New("unsupported type: " + v.Type().String() + " for amf0")
+}
+
+// encodeDate0 writes t as a date, UTC milliseconds followed by the
+// timezone, which is zero unless DateTimezoneOffset is set.
+func (e *Encoder) encodeDate0(t time.Time) error {
+	if err := e.writeMarker(AMF0_DATE_MARKER); err != nil {
+		return err
+	}
+	if err := e.writeUint0(math.Float64bits(float64(t.UnixMilli())), 8); err != nil {
+		return err
+	}
+	var tz int16
+	if e.DateTimezoneOffset {
+		_, offset := t.Zone()
+		tz = int16(offset / 60)
+	}
+	return e.writeUint0(uint64(uint16(tz)), 2)
+}
+
+// encodeArray0 writes the slice or array v as a strict array.
+func (e *Encoder) encodeArray0(v reflect.Value) error {
+	if err := e.writeMarker(AMF0_STRICT_ARRAY_MARKER); err != nil {
+		return err
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+
+	if err := e.writeUint0(uint64(v.Len()), 4); err != nil {
+		return err
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encodeAMF0(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeECMAArray0 writes the map v as an ECMA array, its count followed
+// by the members and the object end.
+func (e *Encoder) encodeECMAArray0(v reflect.Value) error {
+	if err := e.writeMarker(AMF0_ECMA_ARRAY_MARKER); err != nil {
+		return err
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+
+	keys := v.MapKeys()
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		name, err := mapKeyString(k)
+		if err != nil {
+			return err
+		}
+		names[i] = name
+	}
+	if e.Deterministic || e.SortMapKeys {
+		sort.Sort(byKeyName{keys, names})
+	}
+	if err := e.writeUint0(uint64(len(keys)), 4); err != nil {
+		return err
+	}
+	for i, k := range keys {
+		if err := e.writeString0(names[i], 2); err != nil {
+			return err
+		}
+		if err := e.encodeAMF0(v.MapIndex(k)); err != nil {
+			return err
+		}
+	}
+	return e.writeObjectEnd0()
+}
+
+// encodeObject0 writes the struct v as an anonymous object.
+func (e *Encoder) encodeObject0(v reflect.Value) error {
+	if err := e.writeMarker(AMF0_OBJECT_MARKER); err != nil {
+		return err
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+
+	fields := cachedStructInfo(v.Type()).fields
+	for i := range fields {
+		name := e.fieldName(&fields[i])
+		if name == "" {
+			continue
+		}
+		if err := e.writeString0(name, 2); err != nil {
+			return err
+		}
+		if err := e.encodeAMF0(v.Field(fields[i].index)); err != nil {
+			return err
+		}
+	}
+	return e.writeObjectEnd0()
+}
+
+/* ───────────────────── AMF0 low-level IO ───────────────────── */
+
+// readUint reads a big-endian unsigned integer of size bytes.
+func (d *Decoder) readUint(size int) (uint64, error) {
+	b, err := d.readBytes(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+// readString0 reads a string prefixed by its length in size bytes.
+func (d *Decoder) readString0(size int) (string, error) {
+	n, err := d.readUint(size)
+	if err != nil {
+		return "", err
+	}
+	if err := d.checkLen(int(n)); err != nil {
+		return "", err
+	}
+	b, err := d.readBytes(int(n))
+	return string(b), err
+}
+
+func (e *Encoder) writeNumber0(f float64) error {
+	if err := e.writeMarker(AMF0_NUMBER_MARKER); err != nil {
+		return err
+	}
+	return e.writeUint0(math.Float64bits(f), 8)
+}
+
+// writeUint0 writes n as a big-endian unsigned integer of size bytes.
+func (e *Encoder) writeUint0(n uint64, size int) error {
+	b := make([]byte, size)
+	for i := size - 1; i >= 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	return e.writeBytes(b)
+}
+
+// writeString0 writes s prefixed by its length in size bytes.
+func (e *Encoder) writeString0(s string, size int) error {
+	if err := e.writeUint0(uint64(len(s)), size); err != nil {
+		return err
+	}
+	return e.writeBytes([]byte(s))
+}
+
+// writeObjectEnd0 writes the empty key and object end marker closing the
+// members of an object or ECMA array.
+func (e *Encoder) writeObjectEnd0() error {
+	return e.writeBytes([]byte{0x00, 0x00, AMF0_OBJECT_END_MARKER})
+}
@@ -0,0 +1,308 @@
+// Copyright 2011 baihaoping@gmail.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package amf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// amf0 builds the AMF0 encoding of a sequence of values: strings, float64,
+// bool, nil, and amf0Object, whose members are written in order.
+func amf0(values ...AMFAny) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		writeAMF0(&buf, v)
+	}
+	return buf.Bytes()
+}
+
+type amf0Object []AMFAny // alternating keys and values
+
+func writeAMF0(buf *bytes.Buffer, v AMFAny) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(AMF0_NULL_MARKER)
+	case bool:
+		buf.WriteByte(AMF0_BOOLEAN_MARKER)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case float64:
+		buf.WriteByte(AMF0_NUMBER_MARKER)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case string:
+		if len(v) > 0xffff {
+			buf.WriteByte(AMF0_LONG_STRING_MARKER)
+			binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		} else {
+			buf.WriteByte(AMF0_STRING_MARKER)
+			binary.Write(buf, binary.BigEndian, uint16(len(v)))
+		}
+		buf.WriteString(v)
+	case []AMFAny:
+		buf.WriteByte(AMF0_STRICT_ARRAY_MARKER)
+		binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		for _, elem := range v {
+			writeAMF0(buf, elem)
+		}
+	case amf0Object:
+		buf.WriteByte(AMF0_OBJECT_MARKER)
+		for i := 0; i < len(v); i += 2 {
+			key := v[i].(string)
+			binary.Write(buf, binary.BigEndian, uint16(len(key)))
+			buf.WriteString(key)
+			writeAMF0(buf, v[i+1])
+		}
+		buf.Write([]byte{0x00, 0x00, AMF0_OBJECT_END_MARKER})
+	default:
+		panic("amf0: unsupported value")
+	}
+}
+
+type connectParams struct {
+	App            string  `amf.name:"app"`
+	FlashVer       string  `amf.name:"flashVer"`
+	SwfURL         string  `amf.name:"swfUrl"`
+	TcURL          string  `amf.name:"tcUrl"`
+	Fpad           bool    `amf.name:"fpad"`
+	Capabilities   float64 `amf.name:"capabilities"`
+	AudioCodecs    float64 `amf.name:"audioCodecs"`
+	VideoCodecs    float64 `amf.name:"videoCodecs"`
+	VideoFunction  float64 `amf.name:"videoFunction"`
+	PageURL        *string `amf.name:"pageUrl"`
+	ObjectEncoding float64 `amf.name:"objectEncoding"`
+}
+
+// connect is the command message of an RTMP connect, as sent by Flash
+// Player: name, transaction id, command object and a null argument.
+var connect = amf0("connect", 1.0, amf0Object{
+	"app", "live",
+	"flashVer", "WIN 11,2,202,235",
+	"swfUrl", "http://example.com/player.swf",
+	"tcUrl", "rtmp://example.com/live",
+	"fpad", false,
+	"capabilities", 239.0,
+	"audioCodecs", 3575.0,
+	"videoCodecs", 252.0,
+	"videoFunction", 1.0,
+	"pageUrl", nil,
+	"objectEncoding", 3.0,
+}, nil)
+
+func TestAMF0Connect(t *testing.T) {
+	want := connectParams{"live", "WIN 11,2,202,235", "http://example.com/player.swf",
+		"rtmp://example.com/live", false, 239, 3575, 252, 1, nil, 3}
+
+	d := NewDecoder(bytes.NewReader(connect))
+	var name string
+	var id float64
+	var params connectParams
+	var arg AMFAny = "unset"
+	for _, v := range []AMFAny{&name, &id, &params, &arg} {
+		if err := d.DecodeAMF0(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if name != "connect" || id != 1 || params != want || arg != nil {
+		t.Errorf("got %q %v %+v %#v", name, id, params, arg)
+	}
+	if d.BytesRead() != int64(len(connect)) {
+		t.Errorf("read %d bytes, want %d", d.BytesRead(), len(connect))
+	}
+
+	// the command object as a generic map
+	d = NewDecoder(bytes.NewReader(connect))
+	var command []AMFAny
+	for i := 0; i < 4; i++ {
+		var v AMFAny
+		if err := d.DecodeAMF0(&v); err != nil {
+			t.Fatal(err)
+		}
+		command = append(command, v)
+	}
+	m, ok := command[2].(map[string]AMFAny)
+	if !ok || len(m) != 11 || m["tcUrl"] != want.TcURL || m["objectEncoding"] != 3.0 || m["pageUrl"] != nil {
+		t.Errorf("got %#v", command[2])
+	}
+
+	// and through amf3 again
+	var back connectParams
+	if err := NewDecoder(bytes.NewReader(encode(t, &params))).Decode(&back); err != nil || back != want {
+		t.Errorf("amf3 round trip: got %+v, %v", back, err)
+	}
+	var backMap map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(encode(t, m))).Decode(&backMap); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range m {
+		if got := backMap[k]; !reflect.DeepEqual(got, v) {
+			t.Errorf("amf3 round trip %s: got %#v, want %#v", k, got, v)
+		}
+	}
+}
+
+func TestAMF0StrictArray(t *testing.T) {
+	data := amf0([]AMFAny{"a", 2.0, []AMFAny{true}})
+	var v AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).DecodeAMF0(&v); err != nil {
+		t.Fatal(err)
+	}
+	want := []AMFAny{"a", 2.0, []AMFAny{true}}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("got %#v, want %#v", v, want)
+	}
+}
+
+func TestAMF0LongString(t *testing.T) {
+	long := strings.Repeat("x", 70<<10)
+	data := amf0(long)
+	if data[0] != AMF0_LONG_STRING_MARKER {
+		t.Fatalf("marker %#x, want the long string marker", data[0])
+	}
+	var s string
+	if err := NewDecoder(bytes.NewReader(data)).DecodeAMF0(&s); err != nil || s != long {
+		t.Errorf("got %d bytes, %v, want %d", len(s), err, len(long))
+	}
+}
+
+func TestAMF0TypedObject(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteByte(AMF0_TYPED_OBJECT_MARKER)
+	binary.Write(&buf, binary.BigEndian, uint16(len("test.square")))
+	buf.WriteString("test.square")
+	buf.Write(amf0(amf0Object{"side", 5.0})[1:]) // members without the object marker
+	data := buf.Bytes()
+
+	var v AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).DecodeAMF0(&v); err != nil {
+		t.Fatal(err)
+	}
+	if sq, ok := v.(*unionSquare); !ok || sq.Side != 5 {
+		t.Errorf("got %#v, want a *unionSquare", v)
+	}
+	var sq unionSquare
+	if err := NewDecoder(bytes.NewReader(data)).DecodeAMF0(&sq); err != nil || sq.Side != 5 {
+		t.Errorf("got %+v, %v", sq, err)
+	}
+}
+
+// onMetaData is the script data of an FLV stream, as written by FFmpeg:
+// the handler name and an ECMA array of stream properties.
+var onMetaData = []byte{
+	0x02, 0x00, 0x0a, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a',
+	0x08, 0x00, 0x00, 0x00, 0x05,
+	0x00, 0x08, 'd', 'u', 'r', 'a', 't', 'i', 'o', 'n',
+	0x00, 0x40, 0x29, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x07, 'e', 'n', 'c', 'o', 'd', 'e', 'r',
+	0x02, 0x00, 0x0d, 'L', 'a', 'v', 'f', '5', '8', '.', '2', '9', '.', '1', '0', '0',
+	0x00, 0x06, 'h', 'e', 'i', 'g', 'h', 't',
+	0x00, 0x40, 0x86, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x06, 's', 't', 'e', 'r', 'e', 'o',
+	0x01, 0x01,
+	0x00, 0x05, 'w', 'i', 'd', 't', 'h',
+	0x00, 0x40, 0x94, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x09,
+}
+
+func TestEncodeAMF0MetaData(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	e.SortMapKeys = true
+	meta := map[string]AMFAny{
+		"duration": 12.5,
+		"encoder":  "Lavf58.29.100",
+		"height":   720,
+		"stereo":   true,
+		"width":    uint16(1280),
+	}
+	for _, v := range []AMFAny{"onMetaData", meta} {
+		if err := e.EncodeAMF0(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), onMetaData) {
+		t.Errorf("got\n% x\nwant\n% x", buf.Bytes(), onMetaData)
+	}
+
+	d := NewDecoder(bytes.NewReader(onMetaData))
+	var name string
+	var back map[string]AMFAny
+	if err := d.DecodeAMF0(&name); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DecodeAMF0(&back); err != nil {
+		t.Fatal(err)
+	}
+	if name != "onMetaData" || len(back) != 5 || back["width"] != 1280.0 || back["encoder"] != "Lavf58.29.100" {
+		t.Errorf("got %q %#v", name, back)
+	}
+}
+
+func TestEncodeAMF0Shapes(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	params := connectParams{App: "live", TcURL: "rtmp://example.com/live", Capabilities: 239, ObjectEncoding: 3}
+	for _, v := range []AMFAny{[]AMFAny{"a", 2.0, nil}, &params, nil} {
+		if err := e.EncodeAMF0(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := amf0([]AMFAny{"a", 2.0, nil}); !bytes.HasPrefix(buf.Bytes(), want) {
+		t.Errorf("strict array: got % x, want % x", buf.Bytes()[:len(want)], want)
+	}
+
+	d := NewDecoder(&buf)
+	var arr []AMFAny
+	var back connectParams
+	var null AMFAny = "unset"
+	for _, v := range []AMFAny{&arr, &back, &null} {
+		if err := d.DecodeAMF0(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if back != params || null != nil {
+		t.Errorf("got %+v %#v, want %+v", back, null, params)
+	}
+	if err := e.EncodeAMF0(map[AMFAny]AMFAny{1.5: 1}); err == nil {
+		t.Error("non-string map key encoded")
+	}
+}
+
+func TestEncodeAMF0DateTimezone(t *testing.T) {
+	at := time.Date(2011, 5, 1, 12, 30, 0, 0, time.FixedZone("CST", 8*3600))
+	for _, tt := range []struct {
+		offset bool
+		tz     []byte
+	}{
+		{false, []byte{0x00, 0x00}},
+		{true, []byte{0x01, 0xe0}}, // 480 minutes east
+	} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf, false)
+		e.DateTimezoneOffset = tt.offset
+		if err := e.EncodeAMF0(at); err != nil {
+			t.Fatal(err)
+		}
+		want := []byte{AMF0_DATE_MARKER}
+		want = binary.BigEndian.AppendUint64(want, math.Float64bits(float64(at.UnixMilli())))
+		want = append(want, tt.tz...)
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("offset %v: got % x, want % x", tt.offset, buf.Bytes(), want)
+		}
+
+		var back time.Time
+		if err := NewDecoder(&buf).DecodeAMF0(&back); err != nil || !back.Equal(at) {
+			t.Errorf("offset %v: got %v, %v, want %v", tt.offset, back, err, at)
+		}
+	}
+}
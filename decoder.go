@@ -6,74 +6,405 @@
 package amf
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding"
+	"encoding/json"
 	"errors"
 	"io"
 	"math"
+	"math/big"
+	"net"
+	"net/url"
 	"reflect"
 	"strconv"
+	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
+// AMFScanner is implemented by types that decode themselves from a generic
+// value, such as optional wrappers. ScanAMF is called with present false
+// for null and with the decoded value otherwise. A database/sql Scanner is
+// scanned the same way from scalar values only.
+type AMFScanner interface {
+	ScanAMF(present bool, v AMFAny) error
+}
+
 type Decoder struct {
 	reader      io.Reader
 	stringCache []string
-	objectCache []reflect.Value
+	objectCache []objectEntry
+	amf0Cache   []reflect.Value
+	traitCache  []*traitInfo
+	bytesRead   int64
+	capture     []byte
+	capturing   int
+	depth       int
+	objectBase  int
+	bytesBase   int64
+	wanted      map[string]bool
+	wantedDepth int
+	ctx         context.Context
+	reuse       bool
+	fieldOpts   tagOptions // of the struct field being decoded
+
+	// DisallowUnknownFields makes decoding into a struct fail on object keys
+	// without a matching field. Otherwise such values are skipped.
+	DisallowUnknownFields bool
+
+	// PositionalStructs allows an array to be decoded into a struct, element
+	// i filling the i-th exported field.
+	PositionalStructs bool
+
+	// TimeLayout is the layout used to parse a string into a time.Time and
+	// to format a date into a string. It defaults to time.RFC3339.
+	TimeLayout string
+
+	// MaxDepth limits how deeply objects and arrays may nest; zero means
+	// no limit. NewDecoder sets it to DefaultMaxDepth.
+	MaxDepth int
+
+	// MaxObjects limits how many objects, arrays and byte arrays a single
+	// Decode may add to the reference table; zero means no limit.
+	MaxObjects int
+
+	// ObjectType is the map type, keyed by strings, that objects decoded
+	// into an interface are materialized as. It defaults to
+	// map[string]AMFAny.
+	ObjectType reflect.Type
+
+	// MaxCollectionLen limits the length a string, array or byte array may
+	// declare before it is allocated; zero means no limit. NewDecoder sets it to
+	// DefaultMaxCollectionLen.
+	MaxCollectionLen int
+
+	// MergeMaps makes an object member decoded into a map whose key is
+	// already present merge into the existing struct, map or pointed-to
+	// value instead of replacing it, for patch-style updates.
+	MergeMaps bool
+
+	// MaxBytes limits how many bytes a single Decode may consume; zero
+	// means no limit.
+	MaxBytes int
+
+	// SkipUnknownMarkers makes values of the amf3 types the decoder does not
+	// implement, such as XML, vectors and dictionaries, be consumed and
+	// skipped, leaving the target unchanged, instead of failing the decode.
+	SkipUnknownMarkers bool
+
+	// OnUnknownMarker, if set, is called for a marker the decoder does not
+	// implement, after the marker is read, to consume the rest of the
+	// value: with d's methods, or from the reader, which d does not
+	// buffer. The target is left unchanged. Its error fails the decode.
+	OnUnknownMarker func(marker byte, d *Decoder) error
+
+	// AppendSlices grows slices element by element as an array is read
+	// instead of allocating its declared length up front. A truncated
+	// array then leaves the elements decoded so far in the target.
+	AppendSlices bool
+
+	// CaseInsensitiveKeys matches object keys to struct fields ignoring
+	// case across the whole name, as encoding/json does, and underscores
+	// and hyphens, when there is no exact match.
+	CaseInsensitiveKeys bool
+
+	// GetBuffer, if set, returns the slice the contents of a ByteArray of n
+	// bytes are read into, such as one taken from a sync.Pool. It must
+	// have length n. The slice then belongs to the decoded value: the
+	// decoder neither keeps nor reuses it, except to resolve later
+	// references to the same ByteArray within the value, so the caller
+	// may return it to its pool once done with the value.
+	GetBuffer func(n int) []byte
+
+	// CoerceBools decodes a boolean into an integer target as 1 or 0 and
+	// into a string target as "true" or "false" instead of failing.
+	CoerceBools bool
+
+	// NumbersAsFloat64 stores integers decoded into interface targets as
+	// float64, like doubles, as encoding/json does, instead of int32.
+	NumbersAsFloat64 bool
+
+	// DuplicateKeys selects how a member key repeated within one object is
+	// handled. By default the last value wins.
+	DuplicateKeys DuplicateKeyPolicy
 }
 
+// DuplicateKeyPolicy selects the handling of a repeated object member key.
+type DuplicateKeyPolicy int
+
+const (
+	DuplicateKeyLastWins  DuplicateKeyPolicy = iota // decode each value, keeping the last
+	DuplicateKeyFirstWins                           // skip the values after the first
+	DuplicateKeyError                               // fail the decode
+)
+
+const (
+	// DefaultMaxDepth is the MaxDepth of decoders returned by NewDecoder.
+	DefaultMaxDepth = 512
+	// DefaultMaxCollectionLen is the MaxCollectionLen of decoders returned
+	// by NewDecoder.
+	DefaultMaxCollectionLen = 1 << 24
+)
+
+var (
+	ErrMaxDepthExceeded = errors.New("max depth exceeded")
+	ErrMaxBytesExceeded = errors.New("max bytes exceeded")
+)
+
 func NewDecoder(r io.Reader) *Decoder {
-	d := &Decoder{reader: r}
+	d := &Decoder{reader: r, MaxDepth: DefaultMaxDepth, MaxCollectionLen: DefaultMaxCollectionLen}
 	d.Reset()
 	return d
 }
 
 func (d *Decoder) Reset() {
-	d.objectCache = make([]reflect.Value, 0, 10)
+	d.objectCache = make([]objectEntry, 0, 10)
 	d.stringCache = make([]string, 0, 10)
+	d.amf0Cache = nil
+	d.traitCache = nil
+	d.bytesRead = 0
+	d.capture = nil
+	d.capturing = 0
+	d.depth = 0
+}
+
+// Clone returns a decoder with a copy of d's options and reference tables,
+// to decode speculatively and fall back to d. Both read from the same
+// reader, so backtracking needs one that can be rewound, e.g. with Seek.
+func (d *Decoder) Clone() *Decoder {
+	c := *d
+	c.stringCache = append([]string(nil), d.stringCache...)
+	c.objectCache = append([]objectEntry(nil), d.objectCache...)
+	c.amf0Cache = append([]reflect.Value(nil), d.amf0Cache...)
+	c.traitCache = append([]*traitInfo(nil), d.traitCache...)
+	c.capture = append([]byte(nil), d.capture...)
+	return &c
+}
+
+// BytesRead returns the number of bytes consumed from the reader since the
+// decoder was created or last Reset.
+func (d *Decoder) BytesRead() int64 {
+	return d.bytesRead
+}
+
+// StringTable returns a copy of the strings read so far, in reference
+// order.
+func (d *Decoder) StringTable() []string {
+	return append([]string(nil), d.stringCache...)
+}
+
+// ObjectCount returns the number of entries in the object reference table.
+func (d *Decoder) ObjectCount() int {
+	return len(d.objectCache)
 }
 
 /* ─────────────────────── helpers ─────────────────────── */
 
+// getField returns the field of struct type t that the object key decodes
+// into: the first one declared under the key, with its first letter
+// uppercased, or tagged with it.
 func (d *Decoder) getField(key string, t reflect.Type) (reflect.StructField, bool) {
-	r := []rune(key)
 	upperKey := key
-	if len(r) > 0 && unicode.IsLower(r[0]) {
-		r[0] = unicode.ToUpper(r[0])
-		upperKey = string(r)
+	if r, size := utf8.DecodeRuneInString(key); unicode.IsLower(r) {
+		upperKey = string(unicode.ToUpper(r)) + key[size:]
 	}
 
-	for i := 0; i < t.NumField(); i++ {
-		f := t.Field(i)
-		if f.Name == upperKey || f.Tag.Get("amf.name") == key {
-			return f, true
-		}
+	si := cachedStructInfo(t)
+	pos, ok := si.byName[upperKey]
+	if p, tagged := si.byTag[key]; tagged && (!ok || p < pos) {
+		pos, ok = p, true
+	}
+	if !ok && d.CaseInsensitiveKeys {
+		pos, ok = si.folded[foldName(key)]
+	}
+	if !ok {
+		return reflect.StructField{}, false
+	}
+	return t.Field(si.fields[pos].index), true
+}
+
+// wholeRawField returns the index of t's RawMessage field tagged wholeraw,
+// or -1 if there is none.
+func (d *Decoder) wholeRawField(t reflect.Type) int {
+	return cachedStructInfo(t).wholeRaw
+}
+
+// beginCapture starts recording the bytes read and returns the offset at
+// which the recording begins. Captures may nest.
+func (d *Decoder) beginCapture() int {
+	d.capturing++
+	return len(d.capture)
+}
+
+// endCapture stops the capture begun at start and returns a copy of the
+// bytes read since.
+func (d *Decoder) endCapture(start int) []byte {
+	raw := append([]byte(nil), d.capture[start:]...)
+	d.capturing--
+	if d.capturing == 0 {
+		d.capture = d.capture[:0]
 	}
-	return reflect.StructField{}, false
+	return raw
+}
+
+// enter records the start of a nested object or array, failing once
+// MaxDepth is exceeded. Every successful enter must be paired with leave.
+func (d *Decoder) enter() error {
+	if d.MaxDepth > 0 && d.depth >= d.MaxDepth {
+		return ErrMaxDepthExceeded
+	}
+	d.depth++
+	return nil
 }
 
+func (d *Decoder) leave() { d.depth-- }
+
 /* ─────────────────────── decode entry ─────────────────────── */
 
 func (d *Decoder) Decode(v AMFAny) error {
-	return d.decode(reflect.ValueOf(v))
+	return d.DecodeValue(reflect.ValueOf(v))
 }
 
 func (d *Decoder) DecodeValue(v reflect.Value) error {
+	d.start()
 	return d.decode(v)
 }
 
+// start begins a top-level decode, from which MaxObjects and MaxBytes
+// count.
+func (d *Decoder) start() {
+	d.objectBase = len(d.objectCache)
+	d.bytesBase = d.bytesRead
+}
+
 func (d *Decoder) decode(value reflect.Value) error {
 	marker, err := d.readMarker()
 	if err != nil {
 		return err
 	}
+	return d.decodeMarker(marker, value)
+}
+
+// DecodeContext is like Decode but gives up with ctx's error once ctx is
+// done, checking it before every read. If the reader has a
+// SetReadDeadline method, as net.Conn does, a pending read is interrupted
+// by moving the deadline to the past, and the reader is not usable
+// afterwards; other readers are only checked between reads.
+func (d *Decoder) DecodeContext(ctx context.Context, v AMFAny) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.ctx = ctx
+	defer func() { d.ctx = nil }()
+	if r, ok := d.reader.(interface{ SetReadDeadline(time.Time) error }); ok {
+		stop := context.AfterFunc(ctx, func() { r.SetReadDeadline(time.Now()) })
+		defer stop()
+	}
+
+	err := d.Decode(v)
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// DecodeFrame decodes all values in body, a complete message such as an
+// RTMP command payload. The reference tables are shared with the stream
+// decoding; call Reset first if the frame starts fresh tables.
+func (d *Decoder) DecodeFrame(body []byte) ([]AMFAny, error) {
+	r := bytes.NewReader(body)
+	reader := d.reader
+	d.reader = r
+	defer func() { d.reader = reader }()
+
+	var values []AMFAny
+	for r.Len() > 0 {
+		var v AMFAny
+		if err := d.Decode(&v); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return values, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// DumpJSON decodes the next value from r and returns it as indented JSON,
+// for inspecting payloads. Byte arrays are rendered as base64 and times as
+// RFC 3339 strings.
+func DumpJSON(r io.Reader) ([]byte, error) {
+	var v AMFAny
+	if err := NewDecoder(r).Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// DumpJSONTo is like DumpJSON but writes the JSON, followed by a newline,
+// to w.
+func DumpJSONTo(r io.Reader, w io.Writer) error {
+	b, err := DumpJSON(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// DecodeFields decodes the next value, an object, into v populating only
+// the members named in wanted, by wire name or struct field name. Other
+// members are consumed with Skip.
+func (d *Decoder) DecodeFields(wanted []string, v AMFAny) error {
+	d.wanted = make(map[string]bool, len(wanted))
+	for _, name := range wanted {
+		d.wanted[name] = true
+	}
+	d.wantedDepth = d.depth + 1
+	defer func() { d.wanted = nil }()
+	return d.Decode(v)
+}
+
+// DecodeReuse decodes the next value into v like Decode, but reuses the
+// maps and slices already in v: maps are cleared and filled, and slices
+// with enough capacity are resliced to the array length. Elements and
+// fields are decoded in place, so members absent from the input keep
+// their previous values.
+func (d *Decoder) DecodeReuse(v AMFAny) error {
+	d.reuse = true
+	defer func() { d.reuse = false }()
+	return d.Decode(v)
+}
+
+// unwanted reports whether a member of the object being decoded by
+// DecodeFields should be skipped.
+func (d *Decoder) unwanted(key string) bool {
+	return d.wanted != nil && d.depth == d.wantedDepth && !d.wanted[key]
+}
+
+// decodeMarker decodes the value introduced by marker, which has already
+// been read, into value.
+func (d *Decoder) decodeMarker(marker byte, value reflect.Value) error {
+	if s, ok := scannerOf(value, marker); ok {
+		return d.scan(s, marker)
+	}
+	if raw, ok := rawTarget(value); ok {
+		return d.readRaw(raw, marker)
+	}
 
 	/* ----- NULL handling ----- */
 	if marker == NULL_MARKER {
-		if value.IsNil() {
-			return nil
+		if value.Kind() == reflect.Ptr && !value.CanSet() && !value.IsNil() {
+			value = value.Elem() // the caller's target
 		}
 		switch value.Kind() {
 		case reflect.Interface, reflect.Slice, reflect.Map, reflect.Ptr:
-			value.Set(reflect.Zero(value.Type()))
+			if !value.IsNil() {
+				value.Set(reflect.Zero(value.Type()))
+			}
 			return nil
 		default:
 			return errors.New("invalid type: " + value.Type().String() + " for nil")
@@ -86,12 +417,20 @@ func (d *Decoder) decode(value reflect.Value) error {
 			value = v
 		}
 	}
+	var holder reflect.Value // the pointer value was reached through
 	for value.Kind() == reflect.Ptr {
 		if value.IsNil() {
 			value.Set(reflect.New(value.Type().Elem()))
 		}
+		holder = value
 		value = value.Elem()
 	}
+	if s, ok := scannerOf(value, marker); ok {
+		return d.scan(s, marker)
+	}
+	if raw, ok := rawTarget(value); ok {
+		return d.readRaw(raw, marker)
+	}
 
 	/* ----- Dispatch by marker ----- */
 	switch marker {
@@ -108,242 +447,1088 @@ func (d *Decoder) decode(value reflect.Value) error {
 	case ARRAY_MARKER:
 		return d.readSlice(value)
 	case OBJECT_MARKER:
-		return d.readObject(value)
+		if value.Kind() == reflect.Interface && len(unionTypes()) > 0 {
+			return d.readUnion(value)
+		}
+		if value.Kind() == reflect.Struct {
+			if i := d.wholeRawField(value.Type()); i >= 0 {
+				return d.readRawObject(value, i)
+			}
+		}
+		if value.Kind() == reflect.Complex64 || value.Kind() == reflect.Complex128 {
+			return d.readComplex(value)
+		}
+		return d.readObject(value, holder)
+	case BYTEARRAY_MARKER:
+		return d.readByteArray(value)
+	case DATE_MARKER:
+		return d.readDate(value)
+	case DICTIONARY_MARKER:
+		return d.readDictionary(value)
 	default:
+		if d.OnUnknownMarker != nil {
+			return d.OnUnknownMarker(marker, d)
+		}
+		if d.SkipUnknownMarkers {
+			if ok, err := d.skipMarker(marker); ok {
+				return err
+			}
+		}
 		return errors.New("unsupported marker: " + strconv.Itoa(int(marker)))
 	}
 }
 
-/* ───────────────────── primitives ───────────────────── */
-
-func (d *Decoder) setBool(value reflect.Value, v bool) error {
-	switch value.Kind() {
-	case reflect.Bool:
-		value.SetBool(v)
-	case reflect.Interface:
-		value.Set(reflect.ValueOf(v))
+// skipMarker consumes a value of a type the decoder does not implement,
+// following the length rules of the spec, and reports whether it knew how.
+// Skipped objects take their slot in the reference table.
+func (d *Decoder) skipMarker(marker byte) (bool, error) {
+	if marker == UNDEFINED_MARKER {
+		return true, nil
+	}
+	var width int
+	switch marker {
+	case XMLDOC_MARKER, XML_MARKER:
+		width = 1
+	case VECTOR_DOUBLE_MARKER:
+		width = 8
+	case VECTOR_INT_MARKER, VECTOR_UINT_MARKER:
+		width = 4
+	case VECTOR_OBJECT_MARKER:
 	default:
-		return errors.New("invalid type: " + value.Type().String() + " for bool")
+		return false, nil
 	}
-	return nil
-}
 
-func (d *Decoder) readFloat(value reflect.Value) error {
-	bytes, err := d.readBytes(8)
-	if err != nil {
-		return err
+	index, err := d.readU29()
+	if err != nil || index&0x01 == 0 { // a reference has no body
+		return true, err
 	}
-	var n uint64
-	for _, b := range bytes {
-		n = (n << 8) | uint64(b)
+	n := int(index >> 1)
+	if err := d.addObject(reflect.Value{}, marker); err != nil {
+		return true, err
 	}
-	v := math.Float64frombits(n)
 
-	switch value.Kind() {
-	case reflect.Float32, reflect.Float64:
-		value.SetFloat(v)
-	case reflect.Int32, reflect.Int, reflect.Int64:
-		value.SetInt(int64(v))
-	case reflect.Uint32, reflect.Uint, reflect.Uint64:
-		value.SetUint(uint64(v))
-	case reflect.Interface:
-		value.Set(reflect.ValueOf(v))
-	default:
-		return errors.New("invalid type: " + value.Type().String() + " for double")
+	if marker != XMLDOC_MARKER && marker != XML_MARKER {
+		if _, err := d.readMarker(); err != nil { // fixed-length flag
+			return true, err
+		}
+	}
+	if err := d.checkLen(n); err != nil {
+		return true, err
 	}
-	return nil
-}
 
-func (d *Decoder) readInteger(value reflect.Value) error {
-	uv, err := d.readU29()
-	if err != nil {
-		return err
+	if marker == VECTOR_OBJECT_MARKER {
+		var class string
+		if err := d.readString(reflect.ValueOf(&class).Elem()); err != nil {
+			return true, err
+		}
 	}
-	vv := int32(uv)
-	if uv > 0x0fffffff {
-		vv = int32(uv - 0x20000000)
+	if width == 0 {
+		for i := 0; i < n; i++ {
+			if err := d.Skip(); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
 	}
+	_, err = d.readBytes(n * width)
+	return true, err
+}
 
-	switch value.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		value.SetInt(int64(vv))
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		value.SetUint(uint64(uv))
-	case reflect.Interface:
-		value.Set(reflect.ValueOf(uv))
-	default:
-		return errors.New("invalid type: " + value.Type().String() + " for integer")
+// Skip consumes and discards the next value. Nested strings and objects are
+// still entered into the reference tables, so later references into the
+// skipped value resolve; such objects resolve as generic maps and slices.
+func (d *Decoder) Skip() error {
+	var discard AMFAny
+	return d.decode(reflect.ValueOf(&discard).Elem())
+}
+
+// Valid checks that data is a well-formed sequence of amf3 values and
+// returns the first structural error, such as a bad marker, truncation or
+// a reference out of range. Values are walked, not built, under the limits
+// of a decoder from NewDecoder.
+func Valid(data []byte) error {
+	d := NewDecoder(bytes.NewReader(data))
+	for d.bytesRead < int64(len(data)) {
+		if err := d.walk(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
 	}
 	return nil
 }
 
-/* ───────────────────── strings ───────────────────── */
-
-func (d *Decoder) readString(value reflect.Value) error {
-	index, err := d.readU29()
+// walk consumes the next value, checking its structure like decode does.
+// Objects enter the reference table as placeholders.
+func (d *Decoder) walk() error {
+	marker, err := d.readMarker()
 	if err != nil {
 		return err
 	}
-
 	var s string
-	if (index & 0x01) == 0 {
-		s = d.stringCache[int(index>>1)]
-	} else {
-		index >>= 1
-		bytes, err := d.readBytes(int(index))
-		if err != nil {
-			return err
+	switch marker {
+	case UNDEFINED_MARKER, NULL_MARKER, FALSE_MARKER, TRUE_MARKER:
+		return nil
+	case INTEGER_MARKER:
+		_, err := d.readU29()
+		return err
+	case DOUBLE_MARKER:
+		_, err := d.readBytes(8)
+		return err
+	case STRING_MARKER:
+		return d.readString(reflect.ValueOf(&s).Elem())
+	case ARRAY_MARKER, OBJECT_MARKER, BYTEARRAY_MARKER, DATE_MARKER, DICTIONARY_MARKER:
+	default:
+		if d.OnUnknownMarker != nil {
+			return d.OnUnknownMarker(marker, d)
 		}
-		s = string(bytes)
-		if s != "" {
-			d.stringCache = append(d.stringCache, s)
+		if d.SkipUnknownMarkers {
+			if ok, err := d.skipMarker(marker); ok {
+				return err
+			}
 		}
+		return errors.New("unsupported marker: " + strconv.Itoa(int(marker)))
 	}
 
-	switch value.Kind() {
-	case reflect.Int, reflect.Int32, reflect.Int64:
-		num, err := strconv.ParseInt(s, 10, 64)
-		if err != nil {
-			return err
-		}
-		value.SetInt(num)
-	case reflect.Uint, reflect.Uint32, reflect.Uint64:
-		num, err := strconv.ParseUint(s, 10, 64)
-		if err != nil {
-			return err
-		}
-		value.SetUint(num)
-	case reflect.String:
-		value.SetString(s)
-	case reflect.Interface:
-		value.Set(reflect.ValueOf(s))
-	default:
-		return errors.New("invalid type: " + value.Type().String() + " for string")
+	if err := d.enter(); err != nil {
+		return err
 	}
-	return nil
-}
-
-/* ───────────────────── compound (object / slice) ───────────────────── */
-
-func (d *Decoder) readObject(value reflect.Value) error {
+	defer d.leave()
 	index, err := d.readU29()
 	if err != nil {
 		return err
 	}
-
-	/* ----- object reference ----- */
-	if (index & 0x01) == 0 {
-		value.Set(d.objectCache[int(index>>1)])
+	if index&0x01 == 0 {
+		i := int(index >> 1)
+		if i >= len(d.objectCache) {
+			return refRangeError("object", i, len(d.objectCache))
+		}
+		if m := d.objectCache[i].marker; m != marker && m != 0 {
+			return errors.New("invalid reference: marker " + strconv.Itoa(int(marker)) +
+				" refers to a value of marker " + strconv.Itoa(int(m)))
+		}
 		return nil
 	}
-
-	/* ----- dynamic anonymous object ----- */
-	if index != 0x0b {
-		return errors.New("invalid object type")
+	n := int(index >> 1)
+	if marker == DATE_MARKER {
+		n = 8 // the U29 is only a flag
 	}
-	sep, err := d.readMarker()
-	if err != nil {
+	if marker == OBJECT_MARKER {
+		n = 0
+	}
+	if err := d.checkLen(n); err != nil {
 		return err
 	}
-	if sep != 0x01 {
-		return errors.New("typed object not supported")
+	if err := d.addObject(reflect.Value{}, marker); err != nil {
+		return err
 	}
-
-	/* Interface → map[string]AMFAny */
-	if value.Kind() == reflect.Interface {
-		var dummy map[string]AMFAny
-		m := reflect.MakeMap(reflect.TypeOf(dummy))
-		value.Set(m)
-		value = m
+	if marker == BYTEARRAY_MARKER || marker == DATE_MARKER {
+		_, err := d.readBytes(n)
+		return err
 	}
-
-	/* ------ Map target ------ */
-	if value.Kind() == reflect.Map {
-		if value.IsNil() {
-			m := reflect.MakeMap(value.Type())
-			value.Set(m)
-			value = m
+	if marker == DICTIONARY_MARKER {
+		if _, err := d.readMarker(); err != nil { // weak keys flag
+			return err
 		}
-		d.objectCache = append(d.objectCache, value)
-
-		for {
-			var k string
-			if err := d.readString(reflect.ValueOf(&k).Elem()); err != nil {
+		for i := 0; i < 2*n; i++ { // keys and values
+			if err := d.walk(); err != nil {
 				return err
 			}
-			if k == "" {
-				break
-			}
-			elem := reflect.New(value.Type().Elem())
-			if err := d.decode(elem); err != nil {
-				return err
-			}
-			value.SetMapIndex(reflect.ValueOf(k), elem.Elem())
 		}
 		return nil
 	}
 
-	/* ------ Struct target ------ */
-	if value.Kind() != reflect.Struct {
-		return errors.New("struct expected, found: " + value.Type().String())
+	var t *traitInfo
+	if marker == OBJECT_MARKER {
+		if t, err = d.readTraits(index); err != nil {
+			return err
+		}
 	}
-	d.objectCache = append(d.objectCache, value)
-
-	for {
-		var key string
-		if err := d.readString(reflect.ValueOf(&key).Elem()); err != nil {
+	for sealed := 0; ; { // members, or associative pairs of an array
+		key, err := d.nextKey(t, &sealed)
+		if err != nil {
 			return err
 		}
 		if key == "" {
 			break
 		}
-		f, ok := d.getField(key, value.Type())
-		if !ok {
-			return errors.New("key " + key + " not found in struct " + value.Type().String())
+		if err := d.walk(); err != nil {
+			return err
 		}
-		if err := d.decode(value.FieldByName(f.Name)); err != nil {
+	}
+	for i := 0; i < n; i++ {
+		if err := d.walk(); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (d *Decoder) readSlice(value reflect.Value) error {
-	index, err := d.readU29()
-	if err != nil {
-		return err
+// scannerOf returns the AMFScanner that value, or its address, implements,
+// adapting a database/sql Scanner for the scalar value introduced by
+// marker; objects and arrays decode into a Scanner as usual. A pointer that
+// cannot be set is the caller's decode target itself.
+func scannerOf(value reflect.Value, marker byte) (AMFScanner, bool) {
+	var v AMFAny
+	switch {
+	case value.Kind() == reflect.Ptr:
+		if value.CanSet() || value.IsNil() {
+			return nil, false
+		}
+		v = value.Interface()
+	case value.Kind() != reflect.Interface && value.CanAddr():
+		v = value.Addr().Interface()
+	default:
+		return nil, false
 	}
-
-	/* ----- slice reference ----- */
-	if (index & 0x01) == 0 {
-		value.Set(d.objectCache[int(index>>1)])
-		return nil
+	switch s := v.(type) {
+	case AMFScanner:
+		return s, true
+	case sql.Scanner:
+		switch marker {
+		case UNDEFINED_MARKER, NULL_MARKER, FALSE_MARKER, TRUE_MARKER, INTEGER_MARKER,
+			DOUBLE_MARKER, STRING_MARKER, DATE_MARKER, BYTEARRAY_MARKER:
+			return sqlScanner{s}, true
+		}
 	}
-	index >>= 1
+	return nil, false
+}
 
-	sep, err := d.readMarker()
-	if err != nil {
+// sqlScanner decodes into a database/sql Scanner such as sql.NullString.
+type sqlScanner struct{ sql.Scanner }
+
+func (s sqlScanner) ScanAMF(present bool, v AMFAny) error {
+	// pass numbers as driver values; integral doubles as int64 so that
+	// integer columns accept them
+	switch n := v.(type) {
+	case int32:
+		v = int64(n)
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) < 1<<63 {
+			v = int64(n)
+		}
+	}
+	return s.Scan(v)
+}
+
+// scan decodes the value introduced by marker generically and hands it to s.
+func (d *Decoder) scan(s AMFScanner, marker byte) error {
+	if marker == NULL_MARKER {
+		return s.ScanAMF(false, nil)
+	}
+	var v AMFAny
+	if err := d.decodeMarker(marker, reflect.ValueOf(&v).Elem()); err != nil {
+		return err
+	}
+	return s.ScanAMF(true, v)
+}
+
+// rawTarget returns the RawMessage that value is or, for the caller's own
+// pointer, points to.
+func rawTarget(value reflect.Value) (reflect.Value, bool) {
+	if value.Kind() == reflect.Ptr && !value.CanSet() && !value.IsNil() {
+		value = value.Elem()
+	}
+	return value, value.Type() == rawMessageType && value.CanSet()
+}
+
+// readRaw consumes the value introduced by marker and stores its encoding,
+// marker included, in raw.
+func (d *Decoder) readRaw(raw reflect.Value, marker byte) error {
+	start := d.beginCapture()
+	var discard AMFAny
+	err := d.decodeMarker(marker, reflect.ValueOf(&discard).Elem())
+	b := d.endCapture(start)
+	if err != nil {
+		return err
+	}
+	raw.SetBytes(append([]byte{marker}, b...))
+	return nil
+}
+
+/* ───────────────────── primitives ───────────────────── */
+
+func (d *Decoder) setBool(value reflect.Value, v bool) error {
+	switch value.Kind() {
+	case reflect.Bool:
+		value.SetBool(v)
+	case reflect.Interface:
+		value.Set(reflect.ValueOf(v))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !d.CoerceBools {
+			return errors.New("invalid type: " + value.Type().String() + " for bool")
+		}
+		if v {
+			value.SetInt(1)
+		} else {
+			value.SetInt(0)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if !d.CoerceBools {
+			return errors.New("invalid type: " + value.Type().String() + " for bool")
+		}
+		if v {
+			value.SetUint(1)
+		} else {
+			value.SetUint(0)
+		}
+	case reflect.String:
+		if !d.CoerceBools {
+			return errors.New("invalid type: " + value.Type().String() + " for bool")
+		}
+		value.SetString(strconv.FormatBool(v))
+	default:
+		return errors.New("invalid type: " + value.Type().String() + " for bool")
+	}
+	return nil
+}
+
+func (d *Decoder) readFloat(value reflect.Value) error {
+	bytes, err := d.readBytes(8)
+	if err != nil {
+		return err
+	}
+	var n uint64
+	for _, b := range bytes {
+		n = (n << 8) | uint64(b)
+	}
+	return d.setFloat(value, math.Float64frombits(n))
+}
+
+// setFloat stores the double v in value.
+func (d *Decoder) setFloat(value reflect.Value, v float64) error {
+	switch value.Type() {
+	case bigRatType:
+		// the shortest decimal, so that 19.99 is 1999/100 and not the
+		// exact binary fraction
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if _, ok := value.Addr().Interface().(*big.Rat).SetString(s); !ok {
+			return errors.New("invalid rational: " + s)
+		}
+		return nil
+	case bigFloatType:
+		if math.IsNaN(v) {
+			return errors.New("invalid float: NaN")
+		}
+		value.Addr().Interface().(*big.Float).SetFloat64(v)
+		return nil
+	case bigIntType:
+		if v != math.Trunc(v) || math.IsInf(v, 0) {
+			return errors.New("invalid integer: " + strconv.FormatFloat(v, 'g', -1, 64))
+		}
+		new(big.Float).SetFloat64(v).Int(value.Addr().Interface().(*big.Int))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.Float32, reflect.Float64:
+		value.SetFloat(v)
+	case reflect.String:
+		value.SetString(strconv.FormatFloat(v, 'g', -1, 64))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value.Type() == decimalType {
+			v = math.Round(v * 100)
+		}
+		if v != math.Trunc(v) || v < -math.Ldexp(1, 63) || v >= math.Ldexp(1, 63) || value.OverflowInt(int64(v)) {
+			return errors.New("double " + strconv.FormatFloat(v, 'g', -1, 64) + " does not fit " + value.Type().String())
+		}
+		value.SetInt(int64(v))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v < 0 || v != math.Trunc(v) || v >= math.Ldexp(1, 64) || value.OverflowUint(uint64(v)) {
+			return errors.New("double " + strconv.FormatFloat(v, 'g', -1, 64) + " does not fit " + value.Type().String())
+		}
+		value.SetUint(uint64(v))
+	case reflect.Interface:
+		value.Set(reflect.ValueOf(v))
+	default:
+		if value.CanAddr() {
+			if u, ok := value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+				return u.UnmarshalText([]byte(strconv.FormatFloat(v, 'g', -1, 64)))
+			}
+		}
+		return errors.New("invalid type: " + value.Type().String() + " for double")
+	}
+	return nil
+}
+
+func (d *Decoder) readInteger(value reflect.Value) error {
+	uv, err := d.readU29()
+	if err != nil {
+		return err
+	}
+	vv := int32(uv)
+	if uv > 0x0fffffff {
+		vv = int32(uv - 0x20000000)
+	}
+
+	switch value.Type() {
+	case bigIntType:
+		value.Addr().Interface().(*big.Int).SetInt64(int64(vv))
+		return nil
+	case bigFloatType:
+		value.Addr().Interface().(*big.Float).SetInt64(int64(vv))
+		return nil
+	case bigRatType:
+		value.Addr().Interface().(*big.Rat).SetInt64(int64(vv))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value.Type() == decimalType {
+			value.SetInt(int64(vv) * 100)
+			break
+		}
+		if value.OverflowInt(int64(vv)) {
+			return errors.New("integer " + strconv.Itoa(int(vv)) + " overflows " + value.Type().String())
+		}
+		value.SetInt(int64(vv))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if vv < 0 || value.OverflowUint(uint64(vv)) {
+			return errors.New("integer " + strconv.Itoa(int(vv)) + " overflows " + value.Type().String())
+		}
+		value.SetUint(uint64(vv))
+	case reflect.Interface:
+		if d.NumbersAsFloat64 {
+			value.Set(reflect.ValueOf(float64(vv)))
+			break
+		}
+		value.Set(reflect.ValueOf(vv))
+	default:
+		return errors.New("invalid type: " + value.Type().String() + " for integer")
+	}
+	return nil
+}
+
+// mapKey converts the object key k to map key type t, parsing it for
+// integer kinds.
+func mapKey(k string, t reflect.Type) (reflect.Value, error) {
+	key := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		key.SetString(k)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(k, 10, 64)
+		if err != nil || key.OverflowInt(n) {
+			return key, errors.New("invalid key " + strconv.Quote(k) + " for " + t.String())
+		}
+		key.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(k, 10, 64)
+		if err != nil || key.OverflowUint(n) {
+			return key, errors.New("invalid key " + strconv.Quote(k) + " for " + t.String())
+		}
+		key.SetUint(n)
+	default:
+		return key, errors.New("map key must be string or integer, found: " + t.String())
+	}
+	return key, nil
+}
+
+// mapElem returns a pointer to decode the member key of map m into. With
+// MergeMaps set it is seeded with the existing struct, map or non-nil
+// pointer entry; a pointer is decoded through, into the value it points to.
+func (d *Decoder) mapElem(m, key reflect.Value) reflect.Value {
+	if d.MergeMaps {
+		old := m.MapIndex(key)
+		if old.IsValid() && old.Kind() == reflect.Interface && !old.IsNil() {
+			old = old.Elem()
+		}
+		if old.IsValid() && (old.Kind() == reflect.Struct || old.Kind() == reflect.Map ||
+			(old.Kind() == reflect.Ptr && !old.IsNil())) {
+			// decode into the concrete type so an interface entry keeps it
+			elem := reflect.New(old.Type())
+			elem.Elem().Set(old)
+			return elem
+		}
+	}
+	return reflect.New(m.Type().Elem())
+}
+
+/* ───────────────────── strings ───────────────────── */
+
+func (d *Decoder) readString(value reflect.Value) error {
+	index, err := d.readU29()
+	if err != nil {
+		return err
+	}
+
+	var s string
+	if (index & 0x01) == 0 {
+		i := int(index >> 1)
+		if i >= len(d.stringCache) {
+			return refRangeError("string", i, len(d.stringCache))
+		}
+		s = d.stringCache[i]
+	} else {
+		index >>= 1
+		if err := d.checkLen(int(index)); err != nil {
+			return err
+		}
+		bytes, err := d.readBytes(int(index))
+		if err != nil {
+			return err
+		}
+		s = string(bytes)
+		if s != "" {
+			d.stringCache = append(d.stringCache, s)
+		}
+	}
+	return d.setString(value, s)
+}
+
+// setString stores the string s in value, parsing it for non-string kinds.
+func (d *Decoder) setString(value reflect.Value, s string) error {
+	switch value.Type() {
+	case urlType:
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		value.Set(reflect.ValueOf(*u))
+		return nil
+	case hardwareType:
+		// as written by default, see Encoder.StringersAsByteArray
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return err
+		}
+		value.Set(reflect.ValueOf(mac))
+		return nil
+	case timeType:
+		layout := d.TimeLayout
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return errors.New("invalid time " + strconv.Quote(s) + ": " + err.Error())
+		}
+		value.Set(reflect.ValueOf(t))
+		return nil
+	case bigIntType:
+		if _, ok := value.Addr().Interface().(*big.Int).SetString(s, 10); !ok {
+			return errors.New("invalid integer: " + s)
+		}
+		return nil
+	case bigFloatType:
+		f := value.Addr().Interface().(*big.Float)
+		if f.Prec() == 0 {
+			// roughly 3.3 bits per decimal digit, never below float64
+			f.SetPrec(uint(len(s)) * 4)
+			if f.Prec() < 64 {
+				f.SetPrec(64)
+			}
+		}
+		if _, ok := f.SetString(s); !ok {
+			return errors.New("invalid float: " + s)
+		}
+		return nil
+	}
+	if value.CanAddr() {
+		if u, ok := value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return u.UnmarshalText([]byte(s))
+		}
+	}
+
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		num, ok := coerceEnum(value.Type(), s)
+		if !ok {
+			var err error
+			if num, err = strconv.ParseInt(s, 10, 64); err != nil {
+				return err
+			}
+		}
+		if value.OverflowInt(num) {
+			return errors.New("value " + s + " overflows " + value.Type().String())
+		}
+		value.SetInt(num)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		num, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		if value.OverflowUint(num) {
+			return errors.New("value " + s + " overflows " + value.Type().String())
+		}
+		value.SetUint(num)
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Interface:
+		value.Set(reflect.ValueOf(s))
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return errors.New("invalid type: " + value.Type().String() + " for string")
+		}
+		// a flattened single element, see Encoder.FlattenSingleElementSlices
+		v := reflect.MakeSlice(value.Type(), 1, 1)
+		v.Index(0).SetString(s)
+		value.Set(v)
+	default:
+		return errors.New("invalid type: " + value.Type().String() + " for string")
+	}
+	return nil
+}
+
+/* ───────────────────── compound (object / slice) ───────────────────── */
+
+// readObject decodes an object into value. If value was reached through the
+// settable pointer holder, a reference to a struct already decoded makes
+// holder point at that struct, preserving shared and cyclic pointers.
+func (d *Decoder) readObject(value, holder reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	index, err := d.readU29()
+	if err != nil {
+		return err
+	}
+
+	/* ----- object reference ----- */
+	if (index & 0x01) == 0 {
+		if holder.IsValid() && holder.CanSet() && int(index>>1) < len(d.objectCache) {
+			ref := d.objectCache[int(index>>1)]
+			if ref.marker == OBJECT_MARKER && ref.value.Kind() == reflect.Struct && ref.value.CanAddr() && ref.value.Addr().Type() == holder.Type() {
+				holder.Set(ref.value.Addr())
+				return nil
+			}
+		}
+		return d.setReference(value, int(index>>1), OBJECT_MARKER)
+	}
+
+	/* ----- traits ----- */
+	t, err := d.readTraits(index)
+	if err != nil {
+		return err
+	}
+	return d.readMembers(value, t)
+}
+
+// readMembers decodes the members of an object with traits t into value.
+func (d *Decoder) readMembers(value reflect.Value, t *traitInfo) error {
+	value, err := d.objectTarget(value, t.class)
+	if err != nil {
+		return err
+	}
+
+	/* ------ Map target ------ */
+	if value.Kind() == reflect.Map {
+		if value.IsNil() {
+			m := reflect.MakeMap(value.Type())
+			value.Set(m)
+			value = m
+		} else if d.reuse {
+			value.Clear()
+		}
+		if err := d.addObject(value, OBJECT_MARKER); err != nil {
+			return err
+		}
+
+		seen := d.seenKeys()
+		for sealed := 0; ; {
+			k, err := d.nextKey(t, &sealed)
+			if err != nil {
+				return err
+			}
+			if k == "" {
+				break
+			}
+			dup, err := d.duplicate(seen, k, k)
+			if err != nil {
+				return err
+			}
+			if dup || d.unwanted(k) {
+				if err := d.Skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			key, err := mapKey(k, value.Type().Key())
+			if err != nil {
+				return err
+			}
+			elem := d.mapElem(value, key)
+			if err := d.decode(elem); err != nil {
+				return err
+			}
+			value.SetMapIndex(key, elem.Elem())
+		}
+		return nil
+	}
+
+	/* ------ Slice target ------ */
+	if value.Kind() == reflect.Slice {
+		return d.readIndexed(value, t)
+	}
+
+	/* ------ Struct target ------ */
+	if value.Kind() != reflect.Struct {
+		return errors.New("struct expected, found: " + value.Type().String())
+	}
+	if err := d.addObject(value, OBJECT_MARKER); err != nil {
+		return err
+	}
+
+	seen := d.seenKeys()
+	for sealed := 0; ; {
+		key, err := d.nextKey(t, &sealed)
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			break
+		}
+		if !utf8.ValidString(key) {
+			return errors.New("invalid utf-8 in key " + strconv.Quote(key) + " of struct " + value.Type().String())
+		}
+		f, ok := d.getField(key, value.Type())
+		if ok {
+			dup, err := d.duplicate(seen, f.Name, key)
+			if err != nil {
+				return err
+			}
+			if dup {
+				if err := d.Skip(); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if ok && d.unwanted(key) && d.unwanted(f.Name) {
+			if err := d.Skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if !ok {
+			if d.DisallowUnknownFields {
+				return errors.New("key " + key + " not found in struct " + value.Type().String())
+			}
+			if err := d.Skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		opts := d.fieldOpts
+		_, d.fieldOpts = parseTag(f.Tag.Get("amf.name"))
+		err = d.decode(value.FieldByIndex(f.Index))
+		d.fieldOpts = opts
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seenKeys returns the set duplicate records the keys of an object in, or
+// nil when every value is decoded.
+func (d *Decoder) seenKeys() map[string]bool {
+	if d.DuplicateKeys == DuplicateKeyLastWins {
+		return nil
+	}
+	return make(map[string]bool)
+}
+
+// duplicate records the member key of the object being read in seen, under
+// name, the map key or struct field it decodes into, and reports whether
+// its value should be skipped as a repeat.
+func (d *Decoder) duplicate(seen map[string]bool, name, key string) (bool, error) {
+	if seen == nil {
+		return false, nil
+	}
+	if !seen[name] {
+		seen[name] = true
+		return false, nil
+	}
+	if d.DuplicateKeys == DuplicateKeyError {
+		return true, errors.New("duplicate key " + strconv.Quote(key))
+	}
+	return true, nil
+}
+
+// traitInfo describes the members of objects: the sealed member names,
+// whose values come first in order, and whether dynamic members follow.
+type traitInfo struct {
+	class   string
+	sealed  []string
+	dynamic bool
+}
+
+// readTraits reads the traits of an object whose header, after the inline
+// object flag, is index: inline traits, which are added to the traits
+// table, or a reference to ones read before.
+func (d *Decoder) readTraits(index uint32) (*traitInfo, error) {
+	if index&0x02 == 0 {
+		i := int(index >> 2)
+		if i >= len(d.traitCache) {
+			return nil, refRangeError("traits", i, len(d.traitCache))
+		}
+		return d.traitCache[i], nil
+	}
+	if index&0x04 != 0 {
+		return nil, errors.New("externalizable objects are not supported")
+	}
+	n := int(index >> 4)
+	if err := d.checkLen(n); err != nil {
+		return nil, err
+	}
+
+	t := &traitInfo{dynamic: index&0x08 != 0}
+	if err := d.readString(reflect.ValueOf(&t.class).Elem()); err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		var name string
+		if err := d.readString(reflect.ValueOf(&name).Elem()); err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return nil, errors.New("empty sealed member name")
+		}
+		t.sealed = append(t.sealed, name)
+	}
+	d.traitCache = append(d.traitCache, t)
+	return t, nil
+}
+
+// nextKey returns the key of the next member of an object with traits t,
+// sealed counting the sealed members returned so far, or "" at the end.
+// With nil traits every key is read, as for the members of an array.
+func (d *Decoder) nextKey(t *traitInfo, sealed *int) (string, error) {
+	if t != nil && *sealed < len(t.sealed) {
+		*sealed++
+		return t.sealed[*sealed-1], nil
+	}
+	if t != nil && !t.dynamic {
+		return "", nil
+	}
+	var key string
+	err := d.readString(reflect.ValueOf(&key).Elem())
+	return key, err
+}
+
+// complexObject is the object form of a complex number.
+type complexObject struct {
+	Real float64 `amf.name:"real"`
+	Imag float64 `amf.name:"imag"`
+}
+
+// readComplex decodes an object with real and imag members into the
+// complex value.
+func (d *Decoder) readComplex(value reflect.Value) error {
+	var c complexObject
+	if err := d.readObject(reflect.ValueOf(&c).Elem(), reflect.Value{}); err != nil {
+		return err
+	}
+	value.SetComplex(complex(c.Real, c.Imag))
+	return nil
+}
+
+// readUnion decodes an object into an interface. The members of an
+// anonymous object whose traits may hold a discriminator are first read
+// into a map; if one of them is the discriminator of a registered type, the
+// captured bytes are decoded again into that type with the reference
+// tables rewound to their state after the traits. Other objects are decoded
+// directly.
+func (d *Decoder) readUnion(value reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	t, err := d.readObjectHeader(value)
+	if err != nil || t == nil {
+		return err
+	}
+	if !d.mayDiscriminate(t) {
+		return d.readMembers(value, t)
+	}
+
+	nstrings, nobjects, ntraits := len(d.stringCache), len(d.objectCache), len(d.traitCache)
+	read := d.bytesRead
+	start := d.beginCapture()
+	var obj AMFAny
+	err = d.readMembers(reflect.ValueOf(&obj).Elem(), t)
+	raw := d.endCapture(start)
+	if err != nil {
+		return err
+	}
+
+	ut := d.unionType(reflect.ValueOf(obj))
+	if ut == nil {
+		value.Set(reflect.ValueOf(obj))
+		return nil
+	}
+
+	d.stringCache = d.stringCache[:nstrings]
+	d.objectCache = d.objectCache[:nobjects]
+	d.traitCache = d.traitCache[:ntraits]
+
+	// the replayed bytes were already counted, and captured by any
+	// enclosing capture, when first read
+	reader, end := d.reader, d.bytesRead
+	capture, capturing := d.capture, d.capturing
+	d.reader, d.bytesRead = bytes.NewReader(raw), read
+	d.capture, d.capturing = nil, 0
+	v := reflect.New(ut)
+	err = d.readMembers(v.Elem(), t)
+	d.reader, d.bytesRead = reader, end
+	d.capture, d.capturing = capture, capturing
+	if err != nil {
+		return err
+	}
+	value.Set(v)
+	return nil
+}
+
+// readObjectHeader reads the header of an object into value. It returns the
+// traits of an inline object, or nil after resolving a reference.
+func (d *Decoder) readObjectHeader(value reflect.Value) (*traitInfo, error) {
+	index, err := d.readU29()
+	if err != nil {
+		return nil, err
+	}
+	if index&0x01 == 0 {
+		return nil, d.setReference(value, int(index>>1), OBJECT_MARKER)
+	}
+	return d.readTraits(index)
+}
+
+// mayDiscriminate reports whether an object with traits t can have a
+// member that is the discriminator of a registered type. Objects of a
+// class are decoded by their class name instead.
+func (d *Decoder) mayDiscriminate(t *traitInfo) bool {
+	if t.class != "" {
+		return false
+	}
+	if t.dynamic {
+		return true
+	}
+	for _, ut := range unionTypes() {
+		for _, name := range t.sealed {
+			if d.isDiscriminator(name, ut) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isDiscriminator reports whether key names the discriminator field of t.
+func (d *Decoder) isDiscriminator(key string, t reflect.Type) bool {
+	f, ok := d.getField(key, t)
+	_, opts := parseTag(f.Tag.Get("amf.name"))
+	return ok && opts.Contains("discriminator")
+}
+
+// unionType returns the registered type named by a discriminator member of
+// the decoded object m, or nil.
+func (d *Decoder) unionType(m reflect.Value) reflect.Type {
+	if m.Kind() != reflect.Map {
+		return nil
+	}
+	for it := m.MapRange(); it.Next(); {
+		name, ok := it.Value().Interface().(string)
+		if !ok {
+			continue
+		}
+		t, ok := registeredType(name)
+		if !ok {
+			continue
+		}
+		if d.isDiscriminator(it.Key().String(), t) {
+			return t
+		}
+	}
+	return nil
+}
+
+// readRawObject decodes an object into value and stores its complete
+// encoding, marker included, in the RawMessage field at index raw.
+func (d *Decoder) readRawObject(value reflect.Value, raw int) error {
+	start := d.beginCapture()
+	err := d.readObject(value, reflect.Value{})
+	b := d.endCapture(start)
+	if err != nil {
+		return err
+	}
+	value.Field(raw).SetBytes(append([]byte{OBJECT_MARKER}, b...))
+	return nil
+}
+
+func (d *Decoder) readSlice(value reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	index, err := d.readU29()
+	if err != nil {
+		return err
+	}
+
+	/* ----- slice reference ----- */
+	if (index & 0x01) == 0 {
+		return d.setReference(value, int(index>>1), ARRAY_MARKER)
+	}
+	index >>= 1
+	if err := d.checkLen(int(index)); err != nil {
+		return err
+	}
+
+	var key string
+	if err := d.readString(reflect.ValueOf(&key).Elem()); err != nil {
 		return err
 	}
-	if sep != 0x01 {
-		return errors.New("ECMA array not allowed")
+	if key != "" {
+		switch {
+		case value.Kind() == reflect.Map && value.Type().Key().Kind() == reflect.String:
+			return d.readAssoc(value, key, int(index))
+		case value.Kind() == reflect.Interface:
+			m := reflect.ValueOf(make(map[string]AMFAny))
+			value.Set(m)
+			return d.readAssoc(m, key, int(index))
+		}
+		return errors.New("ECMA array not allowed into " + value.Type().String())
 	}
 
-	/* Ensure we have a concrete slice or []AMFAny */
-	if value.IsNil() {
-		var v reflect.Value
-		switch value.Type().Kind() {
-		case reflect.Slice:
-			v = reflect.MakeSlice(value.Type(), int(index), int(index))
-		case reflect.Interface:
-			v = reflect.ValueOf(make([]AMFAny, int(index)))
-		default:
-			return errors.New("invalid type: " + value.Type().String() + " for array")
+	if value.Kind() == reflect.Struct && d.PositionalStructs {
+		return d.readTuple(value, int(index))
+	}
+
+	// a length header costs a few bytes, so past maxPrealloc elements
+	// memory is only committed as elements are actually read
+	reusable := d.reuse && value.Kind() == reflect.Slice && !value.IsNil() && value.Cap() >= int(index)
+	if d.AppendSlices || (int(index) > maxPrealloc && !reusable) {
+		return d.appendSlice(value, int(index))
+	}
+
+	/* Ensure we have a concrete slice of the right length or []AMFAny */
+	switch value.Kind() {
+	case reflect.Slice:
+		if reusable {
+			v := value.Slice(0, int(index))
+			value.Set(v)
+			value = v
+		} else if value.IsNil() || value.Len() != int(index) {
+			v := reflect.MakeSlice(value.Type(), int(index), int(index))
+			value.Set(v)
+			value = v
 		}
+	case reflect.Interface:
+		v := reflect.ValueOf(make([]AMFAny, int(index)))
 		value.Set(v)
 		value = v
+	default:
+		return errors.New("invalid type: " + value.Type().String() + " for array")
+	}
+	if err := d.addObject(value, ARRAY_MARKER); err != nil {
+		return err
 	}
-	d.objectCache = append(d.objectCache, value)
 
 	for i := 0; i < int(index); i++ {
 		if err := d.decode(value.Index(i)); err != nil {
@@ -353,6 +1538,441 @@ func (d *Decoder) readSlice(value reflect.Value) error {
 	return nil
 }
 
+// appendSlice decodes the n elements of an array into a slice grown as
+// they are read, so a lying length allocates nothing up front and a
+// truncated stream leaves the decoded prefix in value. A reference to the
+// array from within its elements resolves to an empty slice.
+func (d *Decoder) appendSlice(value reflect.Value, n int) error {
+	t := value.Type()
+	switch value.Kind() {
+	case reflect.Slice:
+	case reflect.Interface:
+		t = reflect.TypeOf([]AMFAny(nil))
+	default:
+		return errors.New("invalid type: " + t.String() + " for array")
+	}
+
+	s := reflect.MakeSlice(t, 0, 0)
+	slot := len(d.objectCache)
+	if err := d.addObject(s, ARRAY_MARKER); err != nil {
+		return err
+	}
+	defer func() {
+		value.Set(s)
+		d.objectCache[slot].value = s
+	}()
+
+	for i := 0; i < n; i++ {
+		elem := reflect.New(t.Elem()).Elem()
+		if err := d.decode(elem); err != nil {
+			return err
+		}
+		s = reflect.Append(s, elem)
+	}
+	return nil
+}
+
+// objectTarget returns the value an object of class is decoded into. An
+// interface is set to a new value of the registered class, if any, or
+// else to a new map[string]AMFAny or ObjectType.
+func (d *Decoder) objectTarget(value reflect.Value, class string) (reflect.Value, error) {
+	if value.Kind() != reflect.Interface {
+		return value, nil
+	}
+	if t, ok := registeredType(class); ok && class != "" {
+		v := reflect.New(t)
+		value.Set(v)
+		return v.Elem(), nil
+	}
+
+	t := reflect.TypeOf(map[string]AMFAny(nil))
+	if d.ObjectType != nil {
+		t = d.ObjectType
+		if t.Kind() != reflect.Map || t.Key().Kind() != reflect.String {
+			return value, errors.New("invalid ObjectType: " + t.String() + ", string keyed map expected")
+		}
+	}
+	m := reflect.MakeMap(t)
+	value.Set(m)
+	return m, nil
+}
+
+// readIndexed fills a slice from the members of an object keyed by the
+// contiguous indices "0", "1", ..., as some servers send arrays.
+func (d *Decoder) readIndexed(value reflect.Value, t *traitInfo) error {
+	if err := d.addObject(value, OBJECT_MARKER); err != nil {
+		return err
+	}
+
+	elems := make(map[int]reflect.Value)
+	for sealed := 0; ; {
+		k, err := d.nextKey(t, &sealed)
+		if err != nil {
+			return err
+		}
+		if k == "" {
+			break
+		}
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 {
+			return errors.New("key " + strconv.Quote(k) + " is not an index for " + value.Type().String())
+		}
+		if err := d.checkLen(i + 1); err != nil {
+			return err
+		}
+		elem := reflect.New(value.Type().Elem())
+		if err := d.decode(elem); err != nil {
+			return err
+		}
+		elems[i] = elem.Elem()
+	}
+
+	s := reflect.MakeSlice(value.Type(), len(elems), len(elems))
+	for i, elem := range elems {
+		if i >= len(elems) {
+			return errors.New("object keys are not contiguous indices for " + value.Type().String())
+		}
+		s.Index(i).Set(elem)
+	}
+	value.Set(s)
+	return nil
+}
+
+// readAssoc fills a map from the associative members of an array, key being
+// the first one's, followed by its n dense elements keyed by index. Some
+// servers encode dictionaries this way.
+func (d *Decoder) readAssoc(value reflect.Value, key string, n int) error {
+	if value.IsNil() {
+		m := reflect.MakeMap(value.Type())
+		value.Set(m)
+		value = m
+	}
+	if err := d.addObject(value, ARRAY_MARKER); err != nil {
+		return err
+	}
+
+	for key != "" {
+		k := reflect.ValueOf(key).Convert(value.Type().Key())
+		elem := d.mapElem(value, k)
+		if err := d.decode(elem); err != nil {
+			return err
+		}
+		value.SetMapIndex(k, elem.Elem())
+		if err := d.readString(reflect.ValueOf(&key).Elem()); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < n; i++ {
+		k := reflect.ValueOf(strconv.Itoa(i)).Convert(value.Type().Key())
+		elem := d.mapElem(value, k)
+		if err := d.decode(elem); err != nil {
+			return err
+		}
+		value.SetMapIndex(k, elem.Elem())
+	}
+	return nil
+}
+
+func (d *Decoder) readByteArray(value reflect.Value) error {
+	index, err := d.readU29()
+	if err != nil {
+		return err
+	}
+
+	/* ----- byte array reference ----- */
+	if (index & 0x01) == 0 {
+		return d.setReference(value, int(index>>1), BYTEARRAY_MARKER)
+	}
+
+	if err := d.checkLen(int(index >> 1)); err != nil {
+		return err
+	}
+	var b []byte
+	if n := int(index >> 1); d.GetBuffer != nil {
+		if err := d.checkBytes(n); err != nil {
+			return err
+		}
+		b = d.GetBuffer(n)
+		if len(b) != n {
+			return errors.New("GetBuffer returned " + strconv.Itoa(len(b)) + " bytes, " + strconv.Itoa(n) + " expected")
+		}
+		err = d.readFull(b)
+	} else {
+		b, err = d.readBytes(n)
+	}
+	if err != nil {
+		return err
+	}
+	if err := d.addObject(reflect.ValueOf(b), BYTEARRAY_MARKER); err != nil {
+		return err
+	}
+
+	switch {
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8:
+		value.SetBytes(b)
+	case value.Kind() == reflect.Interface:
+		value.Set(reflect.ValueOf(b))
+	default:
+		// serialized amf3 inside, such as a flex remote exception
+		return d.nested(b).decode(value)
+	}
+	return nil
+}
+
+// readDictionary decodes a dictionary into a map, or into a
+// map[AMFAny]AMFAny for an interface. Keys are decoded into the map's key
+// type; an integer keyed map accepts only numeric keys.
+func (d *Decoder) readDictionary(value reflect.Value) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	index, err := d.readU29()
+	if err != nil {
+		return err
+	}
+
+	/* ----- dictionary reference ----- */
+	if (index & 0x01) == 0 {
+		return d.setReference(value, int(index>>1), DICTIONARY_MARKER)
+	}
+	n := int(index >> 1)
+	if err := d.checkLen(n); err != nil {
+		return err
+	}
+	if _, err := d.readMarker(); err != nil { // weak keys flag
+		return err
+	}
+
+	switch value.Kind() {
+	case reflect.Map:
+		if value.IsNil() {
+			m := reflect.MakeMap(value.Type())
+			value.Set(m)
+			value = m
+		} else if d.reuse {
+			value.Clear()
+		}
+	case reflect.Interface:
+		m := reflect.ValueOf(make(map[AMFAny]AMFAny))
+		value.Set(m)
+		value = m
+	default:
+		return errors.New("invalid type: " + value.Type().String() + " for dictionary")
+	}
+	if err := d.addObject(value, DICTIONARY_MARKER); err != nil {
+		return err
+	}
+
+	kt := value.Type().Key()
+	for i := 0; i < n; i++ {
+		marker, err := d.readMarker()
+		if err != nil {
+			return err
+		}
+		switch kt.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if marker != INTEGER_MARKER && marker != DOUBLE_MARKER {
+				return errors.New("invalid dictionary key: marker " + strconv.Itoa(int(marker)) + " for " + kt.String())
+			}
+		}
+		key := reflect.New(kt).Elem()
+		if err := d.decodeMarker(marker, key); err != nil {
+			return err
+		}
+		if kt.Kind() == reflect.Interface && !key.IsNil() && !key.Elem().Comparable() {
+			return errors.New("invalid dictionary key: " + key.Elem().Type().String() + " is not comparable")
+		}
+		elem := d.mapElem(value, key)
+		if err := d.decode(elem); err != nil {
+			return err
+		}
+		value.SetMapIndex(key, elem.Elem())
+	}
+	return nil
+}
+
+// readDate decodes a date, milliseconds since the Unix epoch in UTC, into
+// a time.Time or interface, or as milliseconds into an integer, as seconds
+// into a float or formatted with TimeLayout into a string. A struct field
+// tagged with the seconds or millis option gets that unit instead.
+func (d *Decoder) readDate(value reflect.Value) error {
+	index, err := d.readU29()
+	if err != nil {
+		return err
+	}
+
+	/* ----- date reference ----- */
+	if (index & 0x01) == 0 {
+		i := int(index >> 1)
+		if i >= len(d.objectCache) {
+			return refRangeError("object", i, len(d.objectCache))
+		}
+		ref := d.objectCache[i]
+		if ref.marker != DATE_MARKER || !ref.value.IsValid() {
+			return errors.New("invalid reference: marker " + strconv.Itoa(DATE_MARKER) + " refers to a non-date")
+		}
+		return d.setDate(value, ref.value.Interface().(time.Time))
+	}
+
+	n, err := d.readUint(8)
+	if err != nil {
+		return err
+	}
+	ms := math.Float64frombits(n)
+	if math.IsNaN(ms) || math.IsInf(ms, 0) {
+		return errors.New("invalid date: " + strconv.FormatFloat(ms, 'g', -1, 64))
+	}
+	t := time.UnixMilli(int64(ms)).UTC()
+	if err := d.addObject(reflect.ValueOf(t), DATE_MARKER); err != nil {
+		return err
+	}
+	return d.setDate(value, t)
+}
+
+// setDate stores the date t in value.
+func (d *Decoder) setDate(value reflect.Value, t time.Time) error {
+	if value.Type() == timeType {
+		value.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.Interface:
+		value.Set(reflect.ValueOf(t))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := t.UnixMilli()
+		if d.fieldOpts.Contains("seconds") {
+			n = t.Unix()
+		}
+		if value.OverflowInt(n) {
+			return errors.New("date " + strconv.FormatInt(n, 10) + " overflows " + value.Type().String())
+		}
+		value.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := t.UnixMilli()
+		if d.fieldOpts.Contains("seconds") {
+			n = t.Unix()
+		}
+		if n < 0 || value.OverflowUint(uint64(n)) {
+			return errors.New("date " + strconv.FormatInt(n, 10) + " overflows " + value.Type().String())
+		}
+		value.SetUint(uint64(n))
+	case reflect.Float32, reflect.Float64:
+		f := float64(t.UnixMilli())
+		if !d.fieldOpts.Contains("millis") {
+			f /= 1000
+		}
+		value.SetFloat(f)
+	case reflect.String:
+		layout := d.TimeLayout
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		value.SetString(t.Format(layout))
+	default:
+		return errors.New("invalid type: " + value.Type().String() + " for date")
+	}
+	return nil
+}
+
+// DecodeNested decodes data, the contents of a ByteArray holding serialized
+// amf3, into v. Per the spec the nested value has its own string and
+// object tables; it is decoded with d's options. Decoding a ByteArray into
+// a target other than a byte slice or interface does the same.
+func (d *Decoder) DecodeNested(data []byte, v AMFAny) error {
+	return d.nested(data).Decode(v)
+}
+
+// nested returns a decoder for data with d's options, fresh reference
+// tables and d's depth, so nesting still counts towards MaxDepth.
+func (d *Decoder) nested(data []byte) *Decoder {
+	n := *d
+	n.reader = bytes.NewReader(data)
+	n.Reset()
+	n.depth = d.depth
+	n.start()
+	return &n
+}
+
+// readTuple fills the fields of a struct in declaration order from the n
+// elements of a dense array.
+func (d *Decoder) readTuple(value reflect.Value, n int) error {
+	if err := d.addObject(value, ARRAY_MARKER); err != nil {
+		return err
+	}
+
+	fields := tupleFields(value.Type())
+	if n > len(fields) {
+		return errors.New("array of " + strconv.Itoa(n) + " elements does not fit struct " + value.Type().String())
+	}
+	for i := 0; i < n; i++ {
+		if err := d.decode(value.Field(fields[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLen rejects a collection length read from the stream that exceeds
+// MaxCollectionLen.
+func (d *Decoder) checkLen(n int) error {
+	if d.MaxCollectionLen > 0 && n > d.MaxCollectionLen {
+		return errors.New("collection length " + strconv.Itoa(n) + " exceeds limit " + strconv.Itoa(d.MaxCollectionLen))
+	}
+	return nil
+}
+
+// objectEntry is an entry of the object reference table: a value and the
+// marker that introduced it, which references to it must repeat. The zero
+// entry stands for an object of unknown kind.
+type objectEntry struct {
+	value  reflect.Value
+	marker byte
+}
+
+// addObject appends v, introduced by marker, to the object reference
+// table, enforcing MaxObjects.
+func (d *Decoder) addObject(v reflect.Value, marker byte) error {
+	if d.MaxObjects > 0 && len(d.objectCache)-d.objectBase >= d.MaxObjects {
+		return errors.New("too many objects, limit is " + strconv.Itoa(d.MaxObjects))
+	}
+	d.objectCache = append(d.objectCache, objectEntry{v, marker})
+	return nil
+}
+
+// setReference resolves an object-table reference introduced by marker and
+// stores it into value, checking that the entry was introduced by the same
+// marker.
+func (d *Decoder) setReference(value reflect.Value, index int, marker byte) error {
+	if index >= len(d.objectCache) {
+		return refRangeError("object", index, len(d.objectCache))
+	}
+	entry := d.objectCache[index]
+	if entry.marker != marker {
+		return errors.New("invalid reference: marker " + strconv.Itoa(int(marker)) +
+			" refers to a value of marker " + strconv.Itoa(int(entry.marker)))
+	}
+	ref := entry.value
+	if !ref.IsValid() {
+		return errors.New("invalid reference: marker " + strconv.Itoa(int(marker)) + " refers to a skipped value")
+	}
+	if ref.Kind() == reflect.Struct && ref.CanAddr() && value.Kind() == reflect.Interface {
+		ref = ref.Addr() // structs decoded into interfaces are held by pointer
+	}
+	if !ref.Type().AssignableTo(value.Type()) {
+		return errors.New("invalid type: " + value.Type().String() + " for reference to " + ref.Type().String())
+	}
+	value.Set(ref)
+	return nil
+}
+
+// refRangeError reports a reference to entry index of a table of n.
+func refRangeError(table string, index, n int) error {
+	return errors.New(table + " reference " + strconv.Itoa(index) + " out of range (have " + strconv.Itoa(n) + ")")
+}
+
 /* ───────────────────── low-level IO ───────────────────── */
 
 func (d *Decoder) readU29() (uint32, error) {
@@ -374,16 +1994,71 @@ func (d *Decoder) readU29() (uint32, error) {
 	return ret, nil
 }
 
+// maxPrealloc bounds the elements allocated for an array from its length
+// header before they are read.
+const maxPrealloc = 1 << 12
+
+// maxEmptyReads bounds how many consecutive (0, nil) reads are tolerated
+// before giving up with io.ErrNoProgress.
+const maxEmptyReads = 100
+
 func (d *Decoder) readBytes(n int) ([]byte, error) {
+	if err := d.checkBytes(n); err != nil {
+		return nil, err
+	}
 	buf := make([]byte, n)
-	for n > 0 {
+	if err := d.readFull(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// checkBytes rejects reading n more bytes than MaxBytes leaves, before
+// they are allocated.
+func (d *Decoder) checkBytes(n int) error {
+	if d.MaxBytes > 0 && d.bytesRead-d.bytesBase+int64(n) > int64(d.MaxBytes) {
+		return ErrMaxBytesExceeded
+	}
+	return nil
+}
+
+// readFull fills buf from the reader.
+func (d *Decoder) readFull(buf []byte) error {
+	n := len(buf)
+	if err := d.checkBytes(n); err != nil {
+		return err
+	}
+	for empty := 0; n > 0; {
+		if d.ctx != nil {
+			if err := d.ctx.Err(); err != nil {
+				return err
+			}
+		}
 		read, err := d.reader.Read(buf[len(buf)-n:])
+		d.bytesRead += int64(read)
+		n -= read
+		if n == 0 {
+			break
+		}
 		if err != nil {
-			return nil, err
+			if err == io.EOF && n < len(buf) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if read > 0 {
+			empty = 0
+			continue
+		}
+		empty++
+		if empty >= maxEmptyReads {
+			return io.ErrNoProgress
 		}
-		n -= read
 	}
-	return buf, nil
+	if d.capturing > 0 {
+		d.capture = append(d.capture, buf...)
+	}
+	return nil
 }
 
 func (d *Decoder) readMarker() (byte, error) {
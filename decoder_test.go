@@ -0,0 +1,1870 @@
+// Copyright 2011 baihaoping@gmail.com. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package amf
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// encode returns the amf3 encoding of v with a fresh encoder.
+func encode(t testing.TB, v AMFAny) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf, false).Encode(v); err != nil {
+		t.Fatalf("encode %#v: %v", v, err)
+	}
+	return buf.Bytes()
+}
+
+func TestIntegerBoundary(t *testing.T) {
+	tests := []struct {
+		wire []byte
+		want int32
+	}{
+		{[]byte{INTEGER_MARKER, 0x00}, 0},
+		{[]byte{INTEGER_MARKER, 0x7f}, 127},
+		{[]byte{INTEGER_MARKER, 0xbf, 0xff, 0xff, 0xfe}, 0x0ffffffe},
+		{[]byte{INTEGER_MARKER, 0xbf, 0xff, 0xff, 0xff}, 0x0fffffff},  // 2^28-1, largest
+		{[]byte{INTEGER_MARKER, 0xc0, 0x80, 0x80, 0x00}, -0x10000000}, // -2^28, smallest
+		{[]byte{INTEGER_MARKER, 0xc0, 0x80, 0x80, 0x01}, -0x0fffffff},
+		{[]byte{INTEGER_MARKER, 0xff, 0xff, 0xff, 0xff}, -1},
+	}
+	for _, tt := range tests {
+		var n int64
+		if err := NewDecoder(bytes.NewReader(tt.wire)).Decode(&n); err != nil || n != int64(tt.want) {
+			t.Errorf("% x into int64: got %d, %v, want %d", tt.wire, n, err, tt.want)
+		}
+		var v AMFAny
+		if err := NewDecoder(bytes.NewReader(tt.wire)).Decode(&v); err != nil || v != AMFAny(tt.want) {
+			t.Errorf("% x into interface: got %#v, %v, want %d", tt.wire, v, err, tt.want)
+		}
+		var u uint32
+		err := NewDecoder(bytes.NewReader(tt.wire)).Decode(&u)
+		if tt.want < 0 && err == nil {
+			t.Errorf("% x into uint32: got %d, want error", tt.wire, u)
+		}
+		if tt.want >= 0 && (err != nil || u != uint32(tt.want)) {
+			t.Errorf("% x into uint32: got %d, %v, want %d", tt.wire, u, err, tt.want)
+		}
+	}
+}
+
+func TestIntegerRoundTrip(t *testing.T) {
+	for _, n := range []int64{0, 1, -1, 0x0fffffff, 0x10000000, 0x1fffffff, 0x20000000,
+		-0x10000000, -0x10000001, 0x7fffffff, -0x7fffffff, 1 << 40} {
+		var got int64
+		if err := NewDecoder(bytes.NewReader(encode(t, n))).Decode(&got); err != nil || got != n {
+			t.Errorf("%d: got %d, %v", n, got, err)
+		}
+	}
+}
+
+func TestLyingStringLength(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	e.writeMarker(STRING_MARKER)
+	e.writeU29(1<<28 - 1) // an inline string of 2^27-1 bytes, not sent
+	data := buf.Bytes()
+
+	var s string
+	err := NewDecoder(bytes.NewReader(data)).Decode(&s)
+	if want := "collection length 134217727 exceeds limit 16777216"; err == nil || err.Error() != want {
+		t.Errorf("MaxCollectionLen: got %v, want %q", err, want)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	d := NewDecoder(bytes.NewReader(data))
+	d.MaxCollectionLen = 0
+	d.MaxBytes = 1 << 10
+	if err := d.Decode(&s); err != ErrMaxBytesExceeded {
+		t.Errorf("MaxBytes: got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("allocated %d bytes for %d bytes of input", n, len(data))
+	}
+}
+
+// nullString is an optional string decoded through AMFScanner.
+type nullString struct {
+	String string
+	Valid  bool
+}
+
+func (s *nullString) ScanAMF(present bool, v AMFAny) error {
+	s.String, s.Valid = "", present
+	if present {
+		str, ok := v.(string)
+		if !ok {
+			return errors.New("nullString: unexpected " + reflect.TypeOf(v).String())
+		}
+		s.String = str
+	}
+	return nil
+}
+
+func TestScanner(t *testing.T) {
+	var v struct {
+		Name  nullString `amf.name:"name"`
+		Title nullString `amf.name:"title"`
+	}
+	v.Title = nullString{"stale", true}
+	data := encode(t, map[string]AMFAny{"name": "x", "title": nil})
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != (nullString{"x", true}) || v.Title != (nullString{}) {
+		t.Errorf("got %+v", v)
+	}
+}
+
+func TestNegativeIntegerIntoUnsigned(t *testing.T) {
+	var u uint8
+	err := NewDecoder(bytes.NewReader(encode(t, -1))).Decode(&u)
+	if err == nil || err.Error() != "integer -1 overflows uint8" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLyingArrayLength(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	for i := 0; i < 64; i++ { // nested arrays each claiming the maximum length
+		e.writeMarker(ARRAY_MARKER)
+		e.writeU29(uint32(DefaultMaxCollectionLen)<<1 | 0x01)
+		e.writeString("")
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var v AMFAny
+	if err := NewDecoder(&buf).Decode(&v); err == nil {
+		t.Fatal("truncated input decoded")
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 16<<20 {
+		t.Errorf("allocated %d bytes for %d bytes of input", n, buf.Len())
+	}
+}
+
+type unionSquare struct {
+	Kind string `amf.name:"kind,discriminator"`
+	Side int    `amf.name:"side"`
+}
+
+func init() {
+	RegisterType("test.square", unionSquare{})
+}
+
+func TestUnionInCapture(t *testing.T) {
+	sq := &unionSquare{Side: 2}
+	data := encode(t, []AMFAny{sq, sq})
+
+	var raw RawMessage
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw, data) {
+		t.Errorf("captured % x, want % x", []byte(raw), data)
+	}
+
+	d := NewDecoder(bytes.NewReader(data))
+	d.MaxBytes = len(data)
+	var v []AMFAny
+	if err := d.Decode(&v); err != nil {
+		t.Fatalf("input of MaxBytes: %v", err)
+	}
+	if d.BytesRead() != int64(len(data)) {
+		t.Errorf("read %d bytes, want %d", d.BytesRead(), len(data))
+	}
+	first, ok1 := v[0].(*unionSquare)
+	second, ok2 := v[1].(*unionSquare)
+	if !ok1 || !ok2 || first != second || first.Side != 2 {
+		t.Errorf("got %#v, want the same *unionSquare twice", v)
+	}
+}
+
+func TestECMAArrayIntoInterface(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	if err := e.EncodeECMAArray(nil, map[string]AMFAny{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.EncodeECMAArray([]AMFAny{1.5}, map[string]AMFAny{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.EncodeECMAArray([]AMFAny{"a"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder(&buf)
+	for _, want := range []AMFAny{
+		map[string]AMFAny{"k": "v"},
+		map[string]AMFAny{"0": 1.5, "k": "v"},
+		[]AMFAny{"a"},
+	} {
+		var v AMFAny
+		if err := d.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(v, want) {
+			t.Errorf("got %#v, want %#v", v, want)
+		}
+	}
+}
+
+func TestUnionCaptureByClass(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	e.UseTypeNameAsClass = true
+	e.SealedStructMembers = true
+	if err := e.Encode([]AMFAny{&unionSquare{Side: 3}, &mergeInner{A: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	e.UseTypeNameAsClass = false
+	if err := e.Encode(&mergeInner{B: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder(&buf)
+	var classed []AMFAny
+	if err := d.Decode(&classed); err != nil {
+		t.Fatal(err)
+	}
+	if sq, ok := classed[0].(*unionSquare); !ok || sq.Side != 3 {
+		t.Errorf("registered class: got %#v", classed[0])
+	}
+	if m, ok := classed[1].(map[string]AMFAny); !ok || m["a"] != int32(1) {
+		t.Errorf("unregistered class: got %#v", classed[1])
+	}
+	var sealed AMFAny
+	if err := d.Decode(&sealed); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := sealed.(map[string]AMFAny); !ok || m["b"] != int32(2) {
+		t.Errorf("sealed without discriminator: got %#v", sealed)
+	}
+	if cap(d.capture) != 0 {
+		t.Errorf("captured %d bytes, want none", cap(d.capture))
+	}
+}
+
+func TestECMAArray(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	if err := e.EncodeECMAArray([]AMFAny{"a", "b"}, map[string]AMFAny{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	var v AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	m, ok := v.(map[string]AMFAny)
+	if !ok || len(m) != 3 || m["0"] != "a" || m["1"] != "b" || m["n"] != int32(1) {
+		t.Errorf("got %#v", v)
+	}
+
+	var raw RawMessage
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&raw); err != nil || !bytes.Equal(raw, data) {
+		t.Errorf("raw: got % x, %v", []byte(raw), err)
+	}
+	if _, err := DumpJSON(bytes.NewReader(data)); err != nil {
+		t.Errorf("DumpJSON: %v", err)
+	}
+	d := NewDecoder(bytes.NewReader(append(data, NULL_MARKER)))
+	if err := d.Skip(); err != nil {
+		t.Fatalf("Skip: %v", err)
+	}
+	if err := d.Decode(&v); err != nil || v != nil {
+		t.Errorf("after Skip: got %#v, %v", v, err)
+	}
+
+	// an unknown struct member holding one is skipped
+	buf.Reset()
+	e = NewEncoder(&buf, false)
+	e.writeMarker(OBJECT_MARKER)
+	e.writeTraits("", nil, true)
+	e.writeString("extra")
+	e.EncodeECMAArray(nil, map[string]AMFAny{"k": "v"})
+	e.writeString("side")
+	e.Encode(3)
+	e.writeString("")
+	var sq unionSquare
+	if err := NewDecoder(&buf).Decode(&sq); err != nil || sq.Side != 3 {
+		t.Errorf("got %+v, %v", sq, err)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	inner := map[string]AMFAny{"k": "shared"}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	if err := e.Encode(map[string]AMFAny{"outer": map[string]AMFAny{"inner": inner}}); err != nil {
+		t.Fatal(err)
+	}
+	e.Encode("shared") // a reference into the skipped value's string table
+	e.Encode(inner)    // a reference to an object defined inside it
+
+	d := NewDecoder(&buf)
+	if err := d.Skip(); err != nil {
+		t.Fatalf("Skip: %v", err)
+	}
+	var s string
+	if err := d.Decode(&s); err != nil || s != "shared" {
+		t.Errorf("string after Skip: got %q, %v", s, err)
+	}
+	var v AMFAny
+	if err := d.Decode(&v); err != nil || !reflect.DeepEqual(v, inner) {
+		t.Errorf("object after Skip: got %#v, %v, want %#v", v, err, inner)
+	}
+}
+
+func TestReferenceMarker(t *testing.T) {
+	tests := [][]byte{
+		// an object reference to an array
+		{ARRAY_MARKER, 0x05, 0x01, ARRAY_MARKER, 0x01, 0x01, OBJECT_MARKER, 0x02},
+		// an object reference to a date
+		{ARRAY_MARKER, 0x05, 0x01, DATE_MARKER, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, OBJECT_MARKER, 0x02},
+		// an array reference to a byte array
+		{ARRAY_MARKER, 0x05, 0x01, BYTEARRAY_MARKER, 0x01, ARRAY_MARKER, 0x02},
+	}
+	for _, data := range tests {
+		var v AMFAny
+		if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err == nil {
+			t.Errorf("% x: got %#v, want error", data, v)
+		}
+		if Valid(data) == nil {
+			t.Errorf("% x: valid", data)
+		}
+	}
+}
+
+func TestRawMessageTables(t *testing.T) {
+	shared := &unionSquare{Kind: "test.square", Side: 4}
+	raw := RawMessage(encode(t, []AMFAny{"kind", "x", map[string]AMFAny{"a": "y"}, shared}))
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	if err := e.Encode([]AMFAny{raw, shared, shared, "x", "y"}); err != nil {
+		t.Fatal(err)
+	}
+	var v []AMFAny
+	if err := NewDecoder(&buf).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	first, ok1 := v[1].(*unionSquare)
+	second, ok2 := v[2].(*unionSquare)
+	if !ok1 || !ok2 || first != second || first.Side != 4 {
+		t.Errorf("got %#v, %#v, want the same *unionSquare twice", v[1], v[2])
+	}
+	if v[3] != "x" || v[4] != "y" {
+		t.Errorf("strings after raw: got %#v, %#v", v[3], v[4])
+	}
+}
+
+func TestDecodeContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go server.Write([]byte{ARRAY_MARKER, 0x05, 0x01}) // then blocks for the elements
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		var v AMFAny
+		done <- NewDecoder(client).DecodeContext(ctx, &v)
+	}()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DecodeContext not interrupted")
+	}
+
+	// a reader without deadlines stops at its next read
+	ctx, cancel = context.WithCancel(context.Background())
+	r := cancelReader{iotest.OneByteReader(bytes.NewReader(encode(t, []AMFAny{1, 2, 3}))), cancel}
+	var v AMFAny
+	if err := NewDecoder(r).DecodeContext(ctx, &v); err != context.Canceled {
+		t.Errorf("cancelled: got %v, want %v", err, context.Canceled)
+	}
+}
+
+// cancelReader cancels a context once it has been read from.
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c cancelReader) Read(p []byte) (int, error) {
+	defer c.cancel()
+	return c.r.Read(p)
+}
+
+func BenchmarkDecodeContext(b *testing.B) {
+	data := encode(b, benchRecords(1000))
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for i := 0; i < b.N; i++ {
+		var v []benchRecord
+		if err := NewDecoder(bytes.NewReader(data)).DecodeContext(ctx, &v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDateUTC(t *testing.T) {
+	at := time.Date(2011, 5, 1, 12, 30, 0, 0, time.FixedZone("CST", 8*3600))
+	data := encode(t, at)
+	want := encode(t, at.UTC())
+	if !bytes.Equal(data, want) {
+		t.Errorf("got % x, want % x", data, want)
+	}
+	var ms int64
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&ms); err != nil || ms != at.UnixMilli() {
+		t.Errorf("got %d, %v, want %d", ms, err, at.UnixMilli())
+	}
+}
+
+func TestBigRatDecimal(t *testing.T) {
+	for _, tt := range []struct {
+		v    float64
+		want string
+	}{
+		{19.99, "1999/100"},
+		{0.1, "1/10"},
+		{-2.5, "-5/2"},
+		{3, "3/1"},
+		{1e21, "1000000000000000000000/1"},
+	} {
+		var r big.Rat
+		if err := NewDecoder(bytes.NewReader(encode(t, tt.v))).Decode(&r); err != nil || r.String() != tt.want {
+			t.Errorf("%v: got %s, %v, want %s", tt.v, r.String(), err, tt.want)
+		}
+	}
+	var r big.Rat
+	if err := NewDecoder(bytes.NewReader(encode(t, math.NaN()))).Decode(&r); err == nil {
+		t.Errorf("NaN: got %s", r.String())
+	}
+}
+
+func TestDoubleIntoSigned(t *testing.T) {
+	var i8 int8
+	if err := NewDecoder(bytes.NewReader(encode(t, -128.0))).Decode(&i8); err != nil || i8 != -128 {
+		t.Errorf("got %d, %v", i8, err)
+	}
+	var n int64
+	if err := NewDecoder(bytes.NewReader(encode(t, 1e15))).Decode(&n); err != nil || n != 1e15 {
+		t.Errorf("got %d, %v", n, err)
+	}
+
+	for _, tt := range []struct {
+		v      float64
+		target AMFAny
+	}{
+		{1.5, new(int)},
+		{300, new(int8)},
+		{-40000, new(int16)},
+		{1e19, new(int64)},
+		{math.Inf(-1), new(int64)},
+		{math.NaN(), new(int32)},
+	} {
+		if err := NewDecoder(bytes.NewReader(encode(t, tt.v))).Decode(tt.target); err == nil {
+			t.Errorf("%v into %T: got %v", tt.v, tt.target, reflect.ValueOf(tt.target).Elem())
+		}
+	}
+}
+
+func TestDecodeReuseDictionary(t *testing.T) {
+	data := []byte{DICTIONARY_MARKER, 0x03, 0x00, STRING_MARKER, 0x03, 'a', INTEGER_MARKER, 0x01}
+	m := map[string]int{"old": 9}
+	before := reflect.ValueOf(m).Pointer()
+	if err := NewDecoder(bytes.NewReader(data)).DecodeReuse(&m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m["a"] != 1 {
+		t.Errorf("got %v, want map[a:1]", m)
+	}
+	if reflect.ValueOf(m).Pointer() != before {
+		t.Error("map was reallocated")
+	}
+}
+
+func TestDecodeIntKeyedDictionary(t *testing.T) {
+	data := []byte{DICTIONARY_MARKER, 0x05, 0x00,
+		INTEGER_MARKER, 0x01, STRING_MARKER, 0x07, 'o', 'n', 'e',
+		INTEGER_MARKER, 0x02, STRING_MARKER, 0x07, 't', 'w', 'o'}
+	var m map[int]string
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int]string{1: "one", 2: "two"}; !reflect.DeepEqual(m, want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+	var m64 map[int64]AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&m64); err != nil || m64[2] != "two" {
+		t.Errorf("got %v, %v", m64, err)
+	}
+
+	mismatch := []byte{DICTIONARY_MARKER, 0x03, 0x00, STRING_MARKER, 0x03, 'a', STRING_MARKER, 0x03, 'b'}
+	err := NewDecoder(bytes.NewReader(mismatch)).Decode(&m)
+	if err == nil || !strings.Contains(err.Error(), "invalid dictionary key") {
+		t.Errorf("string key into map[int]string: got %v", err)
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	raw := []byte{'a', 0xff, 0xfe, 'b'}
+	data := append([]byte{STRING_MARKER, byte(len(raw)<<1 | 1)}, raw...)
+	var s string
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil || !bytes.Equal([]byte(s), raw) {
+		t.Errorf("got %q, %v, want %q", s, err, raw)
+	}
+
+	type user struct {
+		Name string
+	}
+	obj := append([]byte{OBJECT_MARKER, 0x0b, 0x01, byte(len(raw)<<1 | 1)}, raw...)
+	obj = append(obj, STRING_MARKER, 0x03, 'x', 0x01)
+	var u user
+	err := NewDecoder(bytes.NewReader(obj)).Decode(&u)
+	if err == nil || !strings.Contains(err.Error(), "invalid utf-8") {
+		t.Errorf("invalid key into struct: got %v", err)
+	}
+	var m map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(obj)).Decode(&m); err != nil || m[string(raw)] != "x" {
+		t.Errorf("invalid key into map: got %#v, %v", m, err)
+	}
+}
+
+func TestSkipUnknownMarkers(t *testing.T) {
+	data := []byte{ARRAY_MARKER, 0x07, 0x01,
+		VECTOR_OBJECT_MARKER, 0x05, 0x00, 0x01, STRING_MARKER, 0x03, 'a', INTEGER_MARKER, 0x02,
+		XML_MARKER, 0x05, '<', 'x',
+		VECTOR_INT_MARKER, 0x03, 0x00, 0, 0, 0, 7}
+	d := NewDecoder(bytes.NewReader(data))
+	d.SkipUnknownMarkers = true
+	var v []AMFAny
+	if err := d.Decode(&v); err != nil || len(v) != 3 || v[0] != nil || v[1] != nil || v[2] != nil {
+		t.Errorf("got %#v, %v", v, err)
+	}
+	if d.BytesRead() != int64(len(data)) {
+		t.Errorf("read %d bytes, want %d", d.BytesRead(), len(data))
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, v := range []AMFAny{
+		map[string]AMFAny{"a": 1, "b": "x", "c": []AMFAny{1.5, true, nil}},
+		map[string]AMFAny{"nested": map[string]AMFAny{"s": "x", "d": time.Unix(0, 0)}},
+		&unionSquare{Kind: "test.square", Side: 1},
+		[]AMFAny{"x", "x", []byte{1, 2}},
+	} {
+		f.Add(encode(f, v))
+	}
+	f.Add([]byte{DICTIONARY_MARKER, 0x03, 0x00, STRING_MARKER, 0x03, 'a', INTEGER_MARKER, 0x01})
+	f.Add([]byte{ARRAY_MARKER, 0x05, 0x01, ARRAY_MARKER, 0x01, 0x01, OBJECT_MARKER, 0x02})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m map[string]AMFAny
+		NewDecoder(bytes.NewReader(data)).Decode(&m)
+		var v AMFAny
+		NewDecoder(bytes.NewReader(data)).Decode(&v)
+		NewDecoder(bytes.NewReader(data)).Skip()
+	})
+}
+
+type benchRecord struct {
+	ID      int
+	Name    string
+	Price   float64
+	Active  bool
+	Tags    []string
+	Comment string `amf.name:"comment,omitempty"`
+}
+
+func benchRecords(n int) []*benchRecord {
+	s := make([]*benchRecord, n)
+	for i := range s {
+		s[i] = &benchRecord{ID: i, Name: "item", Price: float64(i) / 4, Active: i%2 == 0, Tags: []string{"a", "b"}}
+	}
+	return s
+}
+
+func BenchmarkStructSlice(b *testing.B) {
+	records := benchRecords(10000)
+	data := encode(b, records)
+	b.Run("encode", func(b *testing.B) {
+		e := NewEncoder(io.Discard, false)
+		for i := 0; i < b.N; i++ {
+			e.Reset()
+			if err := e.Encode(records); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("decode", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			var v []benchRecord
+			if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestAppendSlicesTruncated(t *testing.T) {
+	data := encode(t, []int{1, 2, 3, 4})
+	data = data[:len(data)-1] // cut within the last element
+	d := NewDecoder(bytes.NewReader(data))
+	d.AppendSlices = true
+	var v []int
+	err := d.Decode(&v)
+	if err != io.ErrUnexpectedEOF && err != io.EOF {
+		t.Errorf("got error %v", err)
+	}
+	if len(v) != 3 || v[0] != 1 || v[1] != 2 || v[2] != 3 {
+		t.Errorf("got %v, want the prefix [1 2 3]", v)
+	}
+}
+
+func BenchmarkAppendSlices(b *testing.B) {
+	data := encode(b, benchRecords(10000))
+	for _, appendSlices := range []bool{false, true} {
+		name := "prealloc"
+		if appendSlices {
+			name = "append"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d := NewDecoder(bytes.NewReader(data))
+				d.AppendSlices = appendSlices
+				var v []benchRecord
+				if err := d.Decode(&v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// wideStruct returns a struct type of 50 int fields Field00 to Field49,
+// every fifth also tagged alias_NN, and the keys a lenient peer might send
+// for them.
+func wideStruct() (reflect.Type, map[string]AMFAny) {
+	var fields []reflect.StructField
+	keys := make(map[string]AMFAny)
+	for i := 0; i < 50; i++ {
+		n := strconv.Itoa(i/10) + strconv.Itoa(i%10)
+		f := reflect.StructField{Name: "Field" + n, Type: reflect.TypeOf(0)}
+		switch {
+		case i%5 == 0:
+			f.Tag = reflect.StructTag(`amf.name:"alias_` + n + `"`)
+			if i%10 == 0 {
+				keys["alias_"+n] = i
+			} else {
+				keys["ALIAS-"+n] = i
+			}
+		case i%3 == 0:
+			keys["field"+n] = i
+		case i%3 == 1:
+			keys["FIELD_"+n] = i
+		default:
+			keys["Field"+n] = i
+		}
+		fields = append(fields, f)
+	}
+	return reflect.StructOf(fields), keys
+}
+
+func TestCaseInsensitiveWideStruct(t *testing.T) {
+	typ, keys := wideStruct()
+	data := encode(t, keys)
+
+	v := reflect.New(typ)
+	d := NewDecoder(bytes.NewReader(data))
+	d.CaseInsensitiveKeys = true
+	d.DisallowUnknownFields = true
+	if err := d.Decode(v.Interface()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if got := v.Elem().Field(i).Int(); got != int64(i) {
+			t.Errorf("%s: got %d, want %d", typ.Field(i).Name, got, i)
+		}
+	}
+}
+
+func BenchmarkCaseInsensitiveWideStruct(b *testing.B) {
+	typ, keys := wideStruct()
+	exact := make(map[string]AMFAny)
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := f.Name
+		if tag := f.Tag.Get("amf.name"); tag != "" {
+			name = tag
+		}
+		exact[name] = i
+	}
+	for _, bm := range []struct {
+		name string
+		keys map[string]AMFAny
+	}{
+		{"exact", exact},
+		{"folded", keys},
+	} {
+		data := encode(b, bm.keys)
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				d := NewDecoder(bytes.NewReader(data))
+				d.CaseInsensitiveKeys = true
+				if err := d.Decode(reflect.New(typ).Interface()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type reuseMessage struct {
+	Name    string
+	Samples []float64
+	Headers map[string]string
+}
+
+func BenchmarkDecodeReuse(b *testing.B) {
+	data := encode(b, &reuseMessage{
+		Name:    "sample",
+		Samples: telemetry(64),
+		Headers: map[string]string{"a": "1", "b": "2", "c": "3"},
+	})
+	b.Run("Decode", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var m reuseMessage
+			if err := NewDecoder(bytes.NewReader(data)).Decode(&m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("DecodeReuse", func(b *testing.B) {
+		b.ReportAllocs()
+		var m reuseMessage
+		for i := 0; i < b.N; i++ {
+			if err := NewDecoder(bytes.NewReader(data)).DecodeReuse(&m); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestDuplicateInlineStrings(t *testing.T) {
+	// "ab" inlined twice takes two slots, so reference 2 is "cd"
+	data := []byte{ARRAY_MARKER, 0x09, 0x01,
+		STRING_MARKER, 0x05, 'a', 'b',
+		STRING_MARKER, 0x05, 'a', 'b',
+		STRING_MARKER, 0x05, 'c', 'd',
+		STRING_MARKER, 0x04}
+	var v []string
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ab", "ab", "cd", "cd"}; !reflect.DeepEqual(v, want) {
+		t.Errorf("got %q, want %q", v, want)
+	}
+	if table := d.StringTable(); len(table) != 3 {
+		t.Errorf("string table %q, want 3 entries", table)
+	}
+}
+
+func TestReferenceOutOfRange(t *testing.T) {
+	for _, data := range [][]byte{
+		{STRING_MARKER, 0x0e},                          // string reference 7
+		{OBJECT_MARKER, 0x0e},                          // object reference 7
+		{ARRAY_MARKER, 0x0e},                           // array reference 7
+		{ARRAY_MARKER, 0x03, 0x01, ARRAY_MARKER, 0x02}, // array reference 1, one ahead
+	} {
+		var v AMFAny
+		if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err == nil {
+			t.Errorf("% x: got %#v, want error", data, v)
+		}
+	}
+}
+
+func TestReferenceOutOfRangeErrors(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{[]byte{STRING_MARKER, 0x0e}, "string reference 7 out of range (have 0)"},
+		{[]byte{OBJECT_MARKER, 0x0e}, "object reference 7 out of range (have 0)"},
+		{[]byte{OBJECT_MARKER, 0x0d}, "traits reference 3 out of range (have 0)"},
+		{[]byte{DATE_MARKER, 0x0e}, "object reference 7 out of range (have 0)"},
+		{[]byte{ARRAY_MARKER, 0x05, 0x01, STRING_MARKER, 0x03, 'a', BYTEARRAY_MARKER, 0x0e},
+			"object reference 7 out of range (have 1)"},
+		{[]byte{ARRAY_MARKER, 0x05, 0x01, STRING_MARKER, 0x03, 'a', STRING_MARKER, 0x02},
+			"string reference 1 out of range (have 1)"},
+	}
+	for _, tt := range tests {
+		var v AMFAny
+		err := NewDecoder(bytes.NewReader(tt.data)).Decode(&v)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("% x: got %v, want %q", tt.data, err, tt.want)
+		}
+		if err := Valid(tt.data); err == nil || err.Error() != tt.want {
+			t.Errorf("% x: Valid got %v, want %q", tt.data, err, tt.want)
+		}
+	}
+}
+
+func TestNestedMaps(t *testing.T) {
+	shared := map[string]AMFAny{"id": "shared"}
+	in := map[string]AMFAny{
+		"name": "top",
+		"child": map[string]AMFAny{
+			"name": "middle",
+			"child": map[string]AMFAny{
+				"name":   "bottom",
+				"values": []AMFAny{"x", int32(1)},
+				"ref":    shared,
+			},
+			"ref": shared,
+		},
+	}
+	var out map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(encode(t, in))).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %#v, want %#v", out, in)
+	}
+
+	middle := out["child"].(map[string]AMFAny)
+	bottom := middle["child"].(map[string]AMFAny)
+	a, b := middle["ref"].(map[string]AMFAny), bottom["ref"].(map[string]AMFAny)
+	if reflect.ValueOf(a).Pointer() != reflect.ValueOf(b).Pointer() {
+		t.Error("shared member decoded as two maps")
+	}
+	if reflect.ValueOf(a).Pointer() == reflect.ValueOf(middle).Pointer() {
+		t.Error("shared member aliases its parent")
+	}
+}
+
+func TestLargeIntegerRoundTrip(t *testing.T) {
+	tests := []struct {
+		v    AMFAny
+		want AMFAny // decoded into an interface, as documented in the README
+	}{
+		{int64(0x100000000), float64(0x100000000)},
+		{uint64(0x100000000), float64(0x100000000)},
+		{int64(math.MaxInt64), "9223372036854775807"},
+		{int64(math.MinInt64), "-9223372036854775808"},
+		{uint64(math.MaxUint64), "18446744073709551615"},
+	}
+	for _, tt := range tests {
+		data := encode(t, tt.v)
+		back := reflect.New(reflect.TypeOf(tt.v))
+		if err := NewDecoder(bytes.NewReader(data)).Decode(back.Interface()); err != nil || back.Elem().Interface() != tt.v {
+			t.Errorf("%T %v: got %v, %v", tt.v, tt.v, back.Elem(), err)
+		}
+		var v AMFAny
+		if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil || v != tt.want {
+			t.Errorf("%T %v into interface: got %#v, %v, want %#v", tt.v, tt.v, v, err, tt.want)
+		}
+	}
+	for _, target := range []AMFAny{new(int8), new(int16), new(int32), new(uint32)} {
+		if err := NewDecoder(bytes.NewReader(encode(t, int64(math.MaxInt64)))).Decode(target); err == nil {
+			t.Errorf("MaxInt64 into %T: got %v", target, reflect.ValueOf(target).Elem())
+		}
+	}
+}
+
+type mergeInner struct {
+	A int `amf.name:"a"`
+	B int `amf.name:"b"`
+}
+
+func TestMergeMaps(t *testing.T) {
+	patch := encode(t, map[string]AMFAny{"old": map[string]AMFAny{"b": 2}, "new": map[string]AMFAny{"b": 3}})
+
+	structs := map[string]mergeInner{"old": {A: 1}}
+	pointers := map[string]*mergeInner{"old": {A: 1}}
+	old := pointers["old"]
+	maps := map[string]AMFAny{"old": map[string]AMFAny{"a": 1}}
+	for _, tt := range []struct {
+		target AMFAny
+		want   AMFAny
+	}{
+		{&structs, map[string]mergeInner{"old": {1, 2}, "new": {0, 3}}},
+		{&pointers, map[string]*mergeInner{"old": {1, 2}, "new": {0, 3}}},
+		{&maps, map[string]AMFAny{"old": map[string]AMFAny{"a": 1, "b": int32(2)}, "new": map[string]AMFAny{"b": int32(3)}}},
+	} {
+		d := NewDecoder(bytes.NewReader(patch))
+		d.MergeMaps = true
+		if err := d.Decode(tt.target); err != nil {
+			t.Fatal(err)
+		}
+		if got := reflect.ValueOf(tt.target).Elem().Interface(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("got %#v, want %#v", got, tt.want)
+		}
+	}
+	if pointers["old"] != old {
+		t.Error("pointer entry replaced")
+	}
+
+	// without MergeMaps the entry is replaced
+	structs = map[string]mergeInner{"old": {A: 1}}
+	if err := NewDecoder(bytes.NewReader(patch)).Decode(&structs); err != nil || structs["old"] != (mergeInner{0, 2}) {
+		t.Errorf("got %#v, %v", structs, err)
+	}
+}
+
+func TestDateEpochUnits(t *testing.T) {
+	at := time.UnixMilli(1300000000250).UTC()
+	var v struct {
+		Ms       int64   `amf.name:"t"`
+		Sec      float64 `amf.name:"t"`
+		IntSec   int64   `amf.name:"t,seconds"`
+		UintMs   uint64  `amf.name:"t,millis"`
+		FloatMs  float32 `amf.name:"t,millis"`
+		FloatSec float64 `amf.name:"t,seconds"`
+		Narrow   int32   `amf.name:"t,seconds"`
+	}
+	fields := reflect.ValueOf(&v).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		// each field alone, as they share a wire name
+		f := fields.Type().Field(i)
+		st := reflect.New(reflect.StructOf([]reflect.StructField{f}))
+		if err := NewDecoder(bytes.NewReader(encode(t, map[string]AMFAny{"t": at}))).Decode(st.Interface()); err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+		fields.Field(i).Set(st.Elem().Field(0))
+	}
+	if v.Ms != 1300000000250 || v.Sec != 1300000000.25 || v.IntSec != 1300000000 || v.UintMs != 1300000000250 ||
+		v.FloatMs != float32(1300000000250) || v.FloatSec != 1300000000.25 || v.Narrow != 1300000000 {
+		t.Errorf("got %+v", v)
+	}
+
+	var narrow struct {
+		Ms int32 `amf.name:"t"`
+	}
+	if err := NewDecoder(bytes.NewReader(encode(t, map[string]AMFAny{"t": at}))).Decode(&narrow); err == nil {
+		t.Errorf("milliseconds into int32: got %d", narrow.Ms)
+	}
+}
+
+type cycleA struct {
+	Name string
+	B    *cycleB
+}
+
+type cycleB struct {
+	Name string
+	A    *cycleA
+}
+
+func TestCyclicStructs(t *testing.T) {
+	a := &cycleA{Name: "a"}
+	a.B = &cycleB{Name: "b", A: a}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	if err := e.Encode(a); err != nil {
+		t.Fatal(err)
+	}
+	if n := e.ObjectCount(); n != 2 {
+		t.Errorf("%d objects written, want 2", n)
+	}
+
+	var back *cycleA
+	if err := NewDecoder(&buf).Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Name != "a" || back.B == nil || back.B.Name != "b" || back.B.A != back {
+		t.Errorf("cycle not restored: %+v, %+v", back, back.B)
+	}
+}
+
+func TestDoubleIntoUnsigned(t *testing.T) {
+	for _, v := range []float64{-1.0, 3.5} {
+		var u uint
+		err := NewDecoder(bytes.NewReader(encode(t, v))).Decode(&u)
+		if want := "double " + strconv.FormatFloat(v, 'g', -1, 64) + " does not fit uint"; err == nil || err.Error() != want {
+			t.Errorf("%v into uint: got %d, %v, want %q", v, u, err, want)
+		}
+	}
+	var u8 uint8
+	if err := NewDecoder(bytes.NewReader(encode(t, 256.0))).Decode(&u8); err == nil {
+		t.Errorf("256 into uint8: got %d", u8)
+	}
+}
+
+// scannedRow implements sql.Scanner but still decodes from an AMF object.
+type scannedRow struct {
+	ID      int    `amf.name:"id"`
+	Scanned string `amf.name:"-"`
+}
+
+func (r *scannedRow) Scan(src interface{}) error {
+	r.Scanned = strconv.Quote(src.(string))
+	return nil
+}
+
+func TestDecodeSQLScanner(t *testing.T) {
+	var s, null sql.NullString
+	if err := NewDecoder(bytes.NewReader(encode(t, "x"))).Decode(&s); err != nil || s != (sql.NullString{String: "x", Valid: true}) {
+		t.Errorf("string into NullString: %+v, %v", s, err)
+	}
+	null.Valid = true
+	if err := NewDecoder(bytes.NewReader(encode(t, nil))).Decode(&null); err != nil || null.Valid {
+		t.Errorf("null into NullString: %+v, %v", null, err)
+	}
+	for _, v := range []AMFAny{int32(7), 7.0} {
+		var n sql.NullInt64
+		if err := NewDecoder(bytes.NewReader(encode(t, v))).Decode(&n); err != nil || n != (sql.NullInt64{Int64: 7, Valid: true}) {
+			t.Errorf("%T into NullInt64: %+v, %v", v, n, err)
+		}
+	}
+
+	var row scannedRow
+	if err := NewDecoder(bytes.NewReader(encode(t, map[string]AMFAny{"id": 3}))).Decode(&row); err != nil || row != (scannedRow{ID: 3}) {
+		t.Errorf("object into Scanner: %+v, %v", row, err)
+	}
+	if err := NewDecoder(bytes.NewReader(encode(t, "y"))).Decode(&row); err != nil || row.Scanned != `"y"` {
+		t.Errorf("string into Scanner: %+v, %v", row, err)
+	}
+}
+
+func TestDisallowUnknownFields(t *testing.T) {
+	data := encode(t, map[string]AMFAny{"side": 2, "extra": []AMFAny{"x", map[string]AMFAny{"y": 1}}})
+
+	var sq unionSquare
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&sq); err != nil || sq.Side != 2 {
+		t.Errorf("lenient: got %+v, %v", sq, err)
+	}
+
+	d := NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields = true
+	err := d.Decode(&sq)
+	if want := "key extra not found in struct amf.unionSquare"; err == nil || err.Error() != want {
+		t.Errorf("strict: got %v, want %q", err, want)
+	}
+}
+
+func TestDecimalRoundTrip(t *testing.T) {
+	type invoice struct {
+		Total Decimal `amf.name:"total"`
+	}
+	for _, tc := range []struct {
+		in   float64
+		want Decimal
+	}{
+		{12.34, 1234},
+		{12.345, 1235}, // half away from zero
+		{-0.125, -13},
+		{0.004, 0},
+	} {
+		var v invoice
+		if err := NewDecoder(bytes.NewReader(encode(t, map[string]AMFAny{"total": tc.in}))).Decode(&v); err != nil || v.Total != tc.want {
+			t.Errorf("%v: got %d, %v, want %d", tc.in, v.Total, err, tc.want)
+		}
+	}
+
+	var back map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(encode(t, &invoice{1234}))).Decode(&back); err != nil || back["total"] != 12.34 {
+		t.Errorf("encoded 1234 cents as %#v, %v", back["total"], err)
+	}
+}
+
+func TestWholeRaw(t *testing.T) {
+	type signed struct {
+		ID  int        `amf.name:"id"`
+		Raw RawMessage `amf.name:",wholeraw"`
+	}
+	obj := encode(t, map[string]AMFAny{"id": 7, "sig": "abc"})
+
+	var v signed
+	if err := NewDecoder(bytes.NewReader(obj)).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.ID != 7 || !bytes.Equal(v.Raw, obj) {
+		t.Errorf("got id %d, raw % x, want % x", v.ID, []byte(v.Raw), obj)
+	}
+
+	// re-emitted inside another value, the object decodes unchanged
+	var back []map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(encode(t, []AMFAny{v.Raw}))).Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	if want := []map[string]AMFAny{{"id": int32(7), "sig": "abc"}}; !reflect.DeepEqual(back, want) {
+		t.Errorf("re-emitted: got %#v", back)
+	}
+}
+
+// stallReader returns (0, nil) from every Read.
+type stallReader struct{}
+
+func (stallReader) Read(p []byte) (int, error) { return 0, nil }
+
+func TestStalledReader(t *testing.T) {
+	done := make(chan error, 1)
+	go func() {
+		var v AMFAny
+		done <- NewDecoder(io.MultiReader(bytes.NewReader([]byte{STRING_MARKER, 0x07, 'a'}), stallReader{})).Decode(&v)
+	}()
+	select {
+	case err := <-done:
+		if err != io.ErrNoProgress {
+			t.Errorf("got %v, want io.ErrNoProgress", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Decode hung on a reader returning (0, nil)")
+	}
+}
+
+func TestPositionalStructs(t *testing.T) {
+	type call struct {
+		Method string
+		ID     int
+		Flag   bool
+	}
+	for _, tc := range []struct {
+		name string
+		in   []AMFAny
+		want call
+		err  string
+	}{
+		{"exact", []AMFAny{"login", 42, true}, call{"login", 42, true}, ""},
+		{"fewer", []AMFAny{"login"}, call{Method: "login"}, ""},
+		{"more", []AMFAny{"login", 42, true, "extra"}, call{}, "array of 4 elements does not fit struct amf.call"},
+	} {
+		d := NewDecoder(bytes.NewReader(encode(t, tc.in)))
+		d.PositionalStructs = true
+		var v call
+		err := d.Decode(&v)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: got %v, want %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || v != tc.want {
+			t.Errorf("%s: got %+v, %v, want %+v", tc.name, v, err, tc.want)
+		}
+	}
+}
+
+func TestRuneAndByte(t *testing.T) {
+	var v struct {
+		R rune `amf.name:"r"`
+		B byte `amf.name:"b"`
+	}
+	if err := NewDecoder(bytes.NewReader(encode(t, map[string]AMFAny{"r": 'é', "b": 255}))).Decode(&v); err != nil || v.R != 'é' || v.B != 255 {
+		t.Errorf("got %+v, %v", v, err)
+	}
+
+	for _, n := range []int{256, -1} {
+		var b byte
+		err := NewDecoder(bytes.NewReader(encode(t, n))).Decode(&b)
+		if want := "integer " + strconv.Itoa(n) + " overflows uint8"; err == nil || err.Error() != want {
+			t.Errorf("%d into byte: got %d, %v, want %q", n, b, err, want)
+		}
+	}
+}
+
+func TestTimeFromString(t *testing.T) {
+	var v struct {
+		At time.Time `amf.name:"at"`
+	}
+	data := encode(t, map[string]AMFAny{"at": "2024-03-01T12:30:00+02:00"})
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC); !v.At.Equal(want) {
+		t.Errorf("got %v, want %v", v.At, want)
+	}
+
+	d := NewDecoder(bytes.NewReader(data))
+	d.TimeLayout = "2006-01-02"
+	err := d.Decode(&v)
+	if err == nil || !strings.HasPrefix(err.Error(), `invalid time "2024-03-01T12:30:00+02:00": `) {
+		t.Errorf("other layout: got %v", err)
+	}
+
+	d = NewDecoder(bytes.NewReader(encode(t, map[string]AMFAny{"at": "2024-03-01"})))
+	d.TimeLayout = "2006-01-02"
+	if err := d.Decode(&v); err != nil || !v.At.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("custom layout: got %v, %v", v.At, err)
+	}
+}
+
+// nestedArrays returns the encoding of depth arrays, each holding the next.
+func nestedArrays(depth int) []byte {
+	b := bytes.Repeat([]byte{ARRAY_MARKER, 0x03, 0x01}, depth)
+	return append(b, NULL_MARKER)
+}
+
+func TestMaxDepth(t *testing.T) {
+	var v AMFAny
+	if err := NewDecoder(bytes.NewReader(nestedArrays(1 << 20))).Decode(&v); err != ErrMaxDepthExceeded {
+		t.Errorf("default: got %v, want ErrMaxDepthExceeded", err)
+	}
+
+	d := NewDecoder(bytes.NewReader(nestedArrays(3)))
+	d.MaxDepth = 3
+	if err := d.Decode(&v); err != nil {
+		t.Errorf("at the limit: %v", err)
+	}
+	d = NewDecoder(bytes.NewReader(nestedArrays(4)))
+	d.MaxDepth = 3
+	if err := d.Decode(&v); err != ErrMaxDepthExceeded {
+		t.Errorf("past the limit: got %v, want ErrMaxDepthExceeded", err)
+	}
+}
+
+func TestMaxObjects(t *testing.T) {
+	items := make([]AMFAny, 10)
+	for i := range items {
+		items[i] = map[string]AMFAny{"i": i}
+	}
+	data := encode(t, items) // the array and its ten objects
+
+	// the limit applies to each Decode
+	d := NewDecoder(bytes.NewReader(append(data, data...)))
+	d.MaxObjects = 11
+	var v []AMFAny
+	for i := 0; i < 2; i++ {
+		if err := d.Decode(&v); err != nil || len(v) != 10 {
+			t.Errorf("at the limit: got %d, %v", len(v), err)
+		}
+	}
+
+	d = NewDecoder(bytes.NewReader(data))
+	d.MaxObjects = 10
+	err := d.Decode(&v)
+	if want := "too many objects, limit is 10"; err == nil || err.Error() != want {
+		t.Errorf("past the limit: got %v, want %q", err, want)
+	}
+}
+
+func TestDecodeFields(t *testing.T) {
+	obj := map[string]AMFAny{"a": 1, "b": "two", "c": 3.5}
+	for i := 0; i < 100; i++ {
+		obj["x"+strconv.Itoa(i)] = []AMFAny{i, map[string]AMFAny{"deep": "v"}}
+	}
+	data := append(encode(t, obj), encode(t, "next")...)
+
+	var v struct {
+		A int     `amf.name:"a"`
+		B string  `amf.name:"b"`
+		C float64 `amf.name:"c"`
+	}
+	v.C = -1
+	d := NewDecoder(bytes.NewReader(data))
+	if err := d.DecodeFields([]string{"a", "B"}, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.A != 1 || v.B != "two" || v.C != -1 {
+		t.Errorf("got %+v, want only a and b set", v)
+	}
+	var next string
+	if err := d.Decode(&next); err != nil || next != "next" {
+		t.Errorf("after DecodeFields: got %q, %v", next, err)
+	}
+
+	var m map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).DecodeFields([]string{"c", "x7"}, &m); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]AMFAny{"c": 3.5, "x7": []AMFAny{int32(7), map[string]AMFAny{"deep": "v"}}}; !reflect.DeepEqual(m, want) {
+		t.Errorf("map: got %#v", m)
+	}
+}
+
+// attrs is a named object type for ObjectType.
+type attrs map[string]string
+
+func TestObjectType(t *testing.T) {
+	data := encode(t, []AMFAny{map[string]AMFAny{"k": "v"}})
+
+	d := NewDecoder(bytes.NewReader(data))
+	d.ObjectType = reflect.TypeOf(map[string]interface{}(nil))
+	var v []AMFAny
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	switch m := v[0].(type) {
+	case map[string]interface{}:
+		if m["k"] != "v" {
+			t.Errorf("got %#v", m)
+		}
+	default:
+		t.Errorf("got %T, want map[string]interface{}", m)
+	}
+
+	d = NewDecoder(bytes.NewReader(data))
+	d.ObjectType = reflect.TypeOf(attrs(nil))
+	if err := d.Decode(&v); err != nil || !reflect.DeepEqual(v[0], attrs{"k": "v"}) {
+		t.Errorf("named type: got %#v, %v", v, err)
+	}
+
+	d = NewDecoder(bytes.NewReader(data))
+	d.ObjectType = reflect.TypeOf([]string(nil))
+	err := d.Decode(&v)
+	if want := "invalid ObjectType: []string, string keyed map expected"; err == nil || err.Error() != want {
+		t.Errorf("slice type: got %v, want %q", err, want)
+	}
+}
+
+func TestDoubleIntoString(t *testing.T) {
+	var v struct {
+		Price string  `amf.name:"price"`
+		Exact big.Rat `amf.name:"exact"`
+	}
+	if err := NewDecoder(bytes.NewReader(encode(t, map[string]AMFAny{"price": 19.99, "exact": 19.99}))).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Price != "19.99" {
+		t.Errorf("string: got %q, want %q", v.Price, "19.99")
+	}
+	if v.Exact.Cmp(big.NewRat(1999, 100)) != 0 {
+		t.Errorf("big.Rat: got %v, want 1999/100", v.Exact.String())
+	}
+}
+
+func TestAssocArrayIntoMap(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf, false).EncodeECMAArray(nil, map[string]AMFAny{"a": 1, "b": 2}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if data[1] != 0x01 {
+		t.Fatalf("dense count header % x, want 01", data[1])
+	}
+
+	var m map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&m); err != nil || !reflect.DeepEqual(m, map[string]AMFAny{"a": int32(1), "b": int32(2)}) {
+		t.Errorf("map[string]AMFAny: got %#v, %v", m, err)
+	}
+	var n map[string]int
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&n); err != nil || !reflect.DeepEqual(n, map[string]int{"a": 1, "b": 2}) {
+		t.Errorf("map[string]int: got %#v, %v", n, err)
+	}
+}
+
+func TestIndexedObjectIntoSlice(t *testing.T) {
+	data := encode(t, map[string]AMFAny{"0": 10, "1": 20})
+	var v []int
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil || !reflect.DeepEqual(v, []int{10, 20}) {
+		t.Errorf("got %v, %v", v, err)
+	}
+
+	err := NewDecoder(bytes.NewReader(encode(t, map[string]AMFAny{"0": 10, "x": 20}))).Decode(&v)
+	if want := `key "x" is not an index for []int`; err == nil || err.Error() != want {
+		t.Errorf("non-numeric key: got %v, want %q", err, want)
+	}
+	err = NewDecoder(bytes.NewReader(encode(t, map[string]AMFAny{"0": 10, "2": 30}))).Decode(&v)
+	if want := "object keys are not contiguous indices for []int"; err == nil || err.Error() != want {
+		t.Errorf("gap: got %v, want %q", err, want)
+	}
+}
+
+func TestCaseInsensitiveKeys(t *testing.T) {
+	type user struct {
+		UserName string
+		Contact  string `amf.name:"contact_email"`
+	}
+	data := encode(t, map[string]AMFAny{"USERNAME": "jdoe", "Contact-Email": "j@example.com"})
+
+	var v user
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil || v != (user{}) {
+		t.Errorf("case sensitive: got %+v, %v", v, err)
+	}
+
+	d := NewDecoder(bytes.NewReader(data))
+	d.CaseInsensitiveKeys = true
+	if err := d.Decode(&v); err != nil || v != (user{"jdoe", "j@example.com"}) {
+		t.Errorf("case insensitive: got %+v, %v", v, err)
+	}
+}
+
+// status is an enum sent by name.
+type status int
+
+const (
+	statusActive status = iota + 1
+	statusSuspended
+)
+
+func init() {
+	RegisterEnum(status(0), func(s string) (int64, bool) {
+		n, ok := map[string]status{"ACTIVE": statusActive, "SUSPENDED": statusSuspended}[s]
+		return int64(n), ok
+	})
+}
+
+func TestRegisterEnum(t *testing.T) {
+	var v struct {
+		Status status `amf.name:"status"`
+		Prev   status `amf.name:"prev"`
+	}
+	if err := NewDecoder(bytes.NewReader(encode(t, map[string]AMFAny{"status": "ACTIVE", "prev": "2"}))).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Status != statusActive || v.Prev != statusSuspended {
+		t.Errorf("got %+v", v)
+	}
+
+	if err := NewDecoder(bytes.NewReader(encode(t, "GONE"))).Decode(&v.Status); err == nil {
+		t.Errorf("unregistered name: got %d", v.Status)
+	}
+}
+
+func TestCloneMidStream(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	if err := e.Encode(map[string]AMFAny{"name": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	// the suffix refers to strings of the first value, so it decodes only
+	// with the tables built so far
+	suffix := []AMFAny{"x", map[string]AMFAny{"name": "y"}}
+	if err := e.Clone().Encode(suffix); err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(buf.Bytes())
+
+	d := NewDecoder(r)
+	var first AMFAny
+	if err := d.Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	mark, _ := r.Seek(0, io.SeekCurrent)
+	table := d.StringTable()
+
+	c := d.Clone()
+	var speculative AMFAny
+	if err := c.Decode(&speculative); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.StringTable(), table) {
+		t.Errorf("clone changed the string table to %q", d.StringTable())
+	}
+
+	r.Seek(mark, io.SeekStart)
+	var again AMFAny
+	if err := d.Decode(&again); err != nil {
+		t.Fatal(err)
+	}
+	want := []AMFAny{"x", map[string]AMFAny{"name": "y"}}
+	if !reflect.DeepEqual(speculative, want) || !reflect.DeepEqual(again, want) {
+		t.Errorf("clone decoded %#v, original %#v, want %#v", speculative, again, want)
+	}
+}
+
+func TestDumpJSON(t *testing.T) {
+	data := encode(t, map[string]AMFAny{
+		"name": "x",
+		"n":    1.5,
+		"list": []AMFAny{1, "a", nil},
+		"blob": []byte{1, 2, 3},
+		"when": time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	got, err := DumpJSON(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "blob": "AQID",
+  "list": [
+    1,
+    "a",
+    null
+  ],
+  "n": 1.5,
+  "name": "x",
+  "when": "2024-01-02T03:04:05Z"
+}`
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBigIntFromString(t *testing.T) {
+	var v struct {
+		N *big.Int  `amf.name:"n"`
+		M big.Int   `amf.name:"m"`
+		F big.Float `amf.name:"f"`
+	}
+	digits := "123456789012345678901234567890"
+	data := encode(t, map[string]AMFAny{"n": digits, "m": "-" + digits, "f": "1.000000000000000000000001"})
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.N == nil || v.N.String() != digits || v.M.String() != "-"+digits {
+		t.Errorf("got %v, %v", v.N, v.M.String())
+	}
+	if v.F.Text('g', -1) != "1.000000000000000000000001" {
+		t.Errorf("big.Float: got %s", v.F.Text('g', -1))
+	}
+
+	err := NewDecoder(bytes.NewReader(encode(t, map[string]AMFAny{"n": "12x"}))).Decode(&v)
+	if want := "invalid integer: 12x"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestValid(t *testing.T) {
+	var stream []byte
+	for _, v := range []AMFAny{
+		nil, true, 42, 1.5, "s",
+		[]AMFAny{"s", map[string]AMFAny{"s": []byte{1, 2}}},
+		time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	} {
+		data := encode(t, v)
+		if err := Valid(data); err != nil {
+			t.Errorf("%#v: %v", v, err)
+		}
+		stream = append(stream, data...)
+	}
+	for _, data := range [][]byte{nil, stream} {
+		if err := Valid(data); err != nil {
+			t.Errorf("% x: %v", data, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"bad marker", []byte{0x42}, "unsupported marker: 66"},
+		{"truncated", []byte{STRING_MARKER, 0x07, 'a'}, "unexpected EOF"},
+		{"bad reference", []byte{ARRAY_MARKER, 0x03, 0x01, STRING_MARKER, 0x02}, "string reference 1 out of range (have 0)"},
+		{"too long", []byte{ARRAY_MARKER, 0xff, 0xff, 0xff, 0xff}, "collection length 268435455 exceeds limit 16777216"},
+		{"too deep", nestedArrays(DefaultMaxDepth + 1), ErrMaxDepthExceeded.Error()},
+	} {
+		if err := Valid(tc.data); err == nil || err.Error() != tc.want {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestNestedByteArrays(t *testing.T) {
+	type fault struct {
+		Code   string `amf.name:"code"`
+		Detail string `amf.name:"detail"`
+	}
+	type envelope struct {
+		Code  string `amf.name:"code"`
+		Fault fault  `amf.name:"fault"`
+	}
+	type message struct {
+		Code string   `amf.name:"code"`
+		Body envelope `amf.name:"body"`
+	}
+	// each level repeats "code", which must not resolve against the
+	// string table of the enclosing level
+	inner := encode(t, map[string]AMFAny{"code": "E1", "detail": "boom"})
+	middle := encode(t, map[string]AMFAny{"code": "code", "fault": inner})
+	data := encode(t, map[string]AMFAny{"code": "top", "body": middle})
+
+	var v message
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if want := (message{"top", envelope{"code", fault{"E1", "boom"}}}); v != want {
+		t.Errorf("got %+v, want %+v", v, want)
+	}
+
+	var e envelope
+	if err := NewDecoder(nil).DecodeNested(middle, &e); err != nil || e != v.Body {
+		t.Errorf("DecodeNested: got %+v, %v", e, err)
+	}
+}
+
+func TestOnUnknownMarker(t *testing.T) {
+	const vendorMarker = 0x20 // followed by a two-byte payload
+	data := []byte{ARRAY_MARKER, 0x07, 0x01, STRING_MARKER, 0x03, 'a', vendorMarker, 0xbe, 0xef, STRING_MARKER, 0x03, 'b'}
+	r := bytes.NewReader(data)
+
+	var payloads [][]byte
+	d := NewDecoder(r)
+	d.OnUnknownMarker = func(marker byte, d *Decoder) error {
+		if marker != vendorMarker {
+			return errors.New("unexpected marker " + strconv.Itoa(int(marker)))
+		}
+		b := make([]byte, 2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		payloads = append(payloads, b)
+		return nil
+	}
+	var v []AMFAny
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, []AMFAny{"a", nil, "b"}) || !reflect.DeepEqual(payloads, [][]byte{{0xbe, 0xef}}) {
+		t.Errorf("got %#v, payloads % x", v, payloads)
+	}
+
+	err := NewDecoder(bytes.NewReader(data)).Decode(&v)
+	if want := "unsupported marker: 32"; err == nil || err.Error() != want {
+		t.Errorf("without a handler: got %v, want %q", err, want)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	items := make([]AMFAny, 200)
+	for i := range items {
+		items[i] = "item" + strconv.Itoa(i) // each a few bytes
+	}
+	data := encode(t, items)
+
+	d := NewDecoder(bytes.NewReader(data))
+	d.MaxBytes = len(data) - 1
+	var v []AMFAny
+	if err := d.Decode(&v); err != ErrMaxBytesExceeded {
+		t.Errorf("got %v, want ErrMaxBytesExceeded", err)
+	}
+
+	// the limit applies to each Decode
+	d = NewDecoder(bytes.NewReader(append(data, data...)))
+	d.MaxBytes = len(data)
+	for i := 0; i < 2; i++ {
+		if err := d.Decode(&v); err != nil || len(v) != len(items) {
+			t.Errorf("decode %d: got %d items, %v", i, len(v), err)
+		}
+	}
+}
+
+type (
+	celsius float64
+	level   int8
+	count   uint16
+	flag    bool
+	label   string
+)
+
+func TestNamedPrimitives(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		v    AMFAny // a pointer to the value to round trip
+	}{
+		{"float", &[]celsius{-40, 21.5}},
+		{"int", &[]level{-128, 0, 127}},
+		{"uint", &[]count{0, 65535}},
+		{"bool", &[]flag{true, false}},
+		{"string", &[]label{"a", ""}},
+		{"enum", &[]status{statusActive, statusSuspended}},
+		{"map keys", &map[label]celsius{"in": 20, "out": -3.5}},
+		{"int map keys", &map[level]flag{1: true, -2: false}},
+		{"fields", &struct {
+			C celsius `amf.name:"c"`
+			L level   `amf.name:"l"`
+			N count   `amf.name:"n"`
+			F flag    `amf.name:"f"`
+			S label   `amf.name:"s"`
+		}{36.6, -5, 9, true, "x"}},
+	} {
+		back := reflect.New(reflect.TypeOf(tc.v).Elem())
+		if err := NewDecoder(bytes.NewReader(encode(t, tc.v))).Decode(back.Interface()); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(back.Interface(), tc.v) {
+			t.Errorf("%s: got %v, want %v", tc.name, back.Elem(), reflect.ValueOf(tc.v).Elem())
+		}
+	}
+
+	err := NewDecoder(bytes.NewReader(encode(t, 128))).Decode(new(level))
+	if want := "integer 128 overflows amf.level"; err == nil || err.Error() != want {
+		t.Errorf("overflow: got %v, want %q", err, want)
+	}
+}
+
+func TestDumpJSONTo(t *testing.T) {
+	data := encode(t, map[string]AMFAny{
+		"at":   time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+		"data": []byte("hi"),
+	})
+	var out bytes.Buffer
+	if err := DumpJSONTo(bytes.NewReader(data), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "{\n  \"at\": \"2024-05-06T07:08:09Z\",\n  \"data\": \"aGk=\"\n}\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	if err := DumpJSONTo(bytes.NewReader([]byte{0x42}), &out); err == nil {
+		t.Error("bad marker dumped")
+	}
+}
+
+func TestGetBuffer(t *testing.T) {
+	blob := []byte("payload")
+	data := encode(t, []AMFAny{blob, []byte{}})
+
+	pool := make([]byte, 64)
+	var sizes []int
+	d := NewDecoder(bytes.NewReader(data))
+	d.GetBuffer = func(n int) []byte {
+		sizes = append(sizes, n)
+		return pool[:n]
+	}
+	var v [][]byte
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sizes, []int{len(blob), 0}) {
+		t.Errorf("GetBuffer called with %v", sizes)
+	}
+	if !bytes.Equal(v[0], blob) || &v[0][0] != &pool[0] {
+		t.Errorf("got %q, not read into the returned buffer", v[0])
+	}
+
+	d = NewDecoder(bytes.NewReader(data))
+	d.GetBuffer = func(n int) []byte { return make([]byte, n+1) }
+	err := d.Decode(&v)
+	if want := "GetBuffer returned 8 bytes, 7 expected"; err == nil || err.Error() != want {
+		t.Errorf("wrong length: got %v, want %q", err, want)
+	}
+}
+
+func TestCoerceBools(t *testing.T) {
+	type flags struct {
+		On    int    `amf.name:"on"`
+		Off   uint8  `amf.name:"off"`
+		Label string `amf.name:"label"`
+	}
+	data := encode(t, map[string]AMFAny{"on": true, "off": false, "label": true})
+
+	var v flags
+	err := NewDecoder(bytes.NewReader(data)).Decode(&v)
+	if err == nil || !strings.HasSuffix(err.Error(), " for bool") {
+		t.Errorf("strict: got %v", err)
+	}
+
+	v = flags{Off: 9}
+	d := NewDecoder(bytes.NewReader(data))
+	d.CoerceBools = true
+	if err := d.Decode(&v); err != nil || v != (flags{1, 0, "true"}) {
+		t.Errorf("coerced: got %+v, %v", v, err)
+	}
+}
+
+func TestNumbersAsFloat64(t *testing.T) {
+	data := encode(t, map[string]AMFAny{"i": 3, "d": 1.5, "list": []AMFAny{-1, 2.25}})
+
+	d := NewDecoder(bytes.NewReader(data))
+	d.NumbersAsFloat64 = true
+	var v map[string]AMFAny
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]AMFAny{"i": 3.0, "d": 1.5, "list": []AMFAny{-1.0, 2.25}}; !reflect.DeepEqual(v, want) {
+		t.Errorf("got %#v, want %#v", v, want)
+	}
+
+	// typed targets are unaffected
+	var typed struct {
+		I int32 `amf.name:"i"`
+	}
+	d = NewDecoder(bytes.NewReader(data))
+	d.NumbersAsFloat64 = true
+	if err := d.Decode(&typed); err != nil || typed.I != 3 {
+		t.Errorf("typed: got %+v, %v", typed, err)
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	e.writeMarker(OBJECT_MARKER)
+	e.writeTraits("", nil, true)
+	for _, n := range []int{1, 2} {
+		e.writeString("side")
+		e.Encode(n)
+	}
+	e.writeString("")
+	data := buf.Bytes()
+
+	for _, tc := range []struct {
+		policy DuplicateKeyPolicy
+		want   int
+		err    string
+	}{
+		{DuplicateKeyLastWins, 2, ""},
+		{DuplicateKeyFirstWins, 1, ""},
+		{DuplicateKeyError, 0, `duplicate key "side"`},
+	} {
+		d := NewDecoder(bytes.NewReader(data))
+		d.DuplicateKeys = tc.policy
+		var m map[string]int
+		err := d.Decode(&m)
+
+		d = NewDecoder(bytes.NewReader(data))
+		d.DuplicateKeys = tc.policy
+		var sq unionSquare
+		serr := d.Decode(&sq)
+
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err || serr == nil || serr.Error() != tc.err {
+				t.Errorf("policy %d: got %v and %v, want %q", tc.policy, err, serr, tc.err)
+			}
+			continue
+		}
+		if err != nil || serr != nil || m["side"] != tc.want || sq.Side != tc.want {
+			t.Errorf("policy %d: got map %v, %v and struct %+v, %v, want %d", tc.policy, m, err, sq, serr, tc.want)
+		}
+	}
+}
+
+func TestComplexRoundTrip(t *testing.T) {
+	type sample struct {
+		Z  complex128 `amf.name:"z"`
+		Z8 complex64  `amf.name:"z8"`
+	}
+	data := encode(t, &sample{complex(1.5, -2.5), complex(0.5, 4)})
+
+	var raw map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]AMFAny{"real": 1.5, "imag": -2.5}; !reflect.DeepEqual(raw["z"], want) {
+		t.Errorf("encoded as %#v, want %#v", raw["z"], want)
+	}
+
+	var back sample
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&back); err != nil || back != (sample{complex(1.5, -2.5), complex(0.5, 4)}) {
+		t.Errorf("got %+v, %v", back, err)
+	}
+}
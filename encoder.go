@@ -4,23 +4,143 @@
 package amf
 
 import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"math"
+	"math/big"
+	"net/url"
 	"reflect"
+	"sort"
 	"strconv"
-	"unicode"
+	"sync"
+	"time"
 )
 
 type Encoder struct {
 	writer       io.Writer
 	stringCache  map[string]int
-	objectCache  map[uintptr]int
+	stringList   []string
+	objectCache  map[objectKey]int
+	objectCount  int
+	valueCache   map[valueKey][]cachedValue
+	identities   map[interface{}]int
+	traitCache   map[traitKey]int
+	traits       []*traitInfo
 	reservStruct bool
+	bytesWritten int64
+	depth        int
+
+	// DedupValues makes deep-equal objects, maps and slices encode as
+	// references to the first occurrence, not only identical pointers.
+	DedupValues bool
+
+	// UnsupportedAsNull encodes nil channels, funcs and unsafe pointers as
+	// null instead of failing.
+	UnsupportedAsNull bool
+
+	// NilSlice and NilMap select how nil slices and nil maps are encoded.
+	// By default they are null, like nil pointers, while empty ones are
+	// empty arrays and objects.
+	NilSlice NilPolicy
+	NilMap   NilPolicy
+
+	// StringersAsByteArray encodes byte slice types that implement
+	// fmt.Stringer, such as net.HardwareAddr, as a ByteArray rather than
+	// as their String() form.
+	StringersAsByteArray bool
+
+	// IdentityFunc, if set, gives the logical identity of an object, map or
+	// slice (structs are passed by pointer). A value whose key was seen
+	// before is encoded as a reference to the first one. Keys must be
+	// comparable.
+	IdentityFunc func(v reflect.Value) (key interface{}, ok bool)
+
+	// UseTypeNameAsClass writes structs with their registered name, see
+	// RegisterType, or else their Go type name as the class name, so a
+	// decoder with the same registrations restores the type.
+	UseTypeNameAsClass bool
+
+	// Deterministic writes object members in sorted name order and every
+	// string inline, so the bytes of a value do not depend on what was
+	// encoded before. Repeated pointers are still written as references,
+	// which keeps cyclic values encodable.
+	Deterministic bool
+
+	// SortMapKeys writes the members of maps in sorted key order, so the
+	// same map encodes to the same bytes within a stream. Deterministic
+	// implies it.
+	SortMapKeys bool
+
+	// AllNumbersAsDouble writes integers as doubles instead of with the
+	// integer marker, for clients that mishandle it.
+	AllNumbersAsDouble bool
+
+	// FlattenSingleElementSlices writes a string slice map value of one
+	// element, as in url.Values or http.Header, as that string. The
+	// decoder reads such a string back into a string slice.
+	FlattenSingleElementSlices bool
+
+	// DateTimezoneOffset records the offset of a time.Time's location, in
+	// minutes east of UTC, in the timezone field of AMF0 dates as AMF0 era
+	// peers expect. The milliseconds are UTC either way, and amf3 dates
+	// have no timezone field.
+	DateTimezoneOffset bool
+
+	// SealedStructMembers writes the field names of a struct once per type
+	// as the sealed members of its traits, which later objects of the type
+	// refer to, instead of as dynamic members of every object.
+	SealedStructMembers bool
+
+	// OnWrite, if set, is called with the marker and nesting depth of each
+	// value as it is written.
+	OnWrite func(marker byte, depth int)
+}
+
+// objectKey identifies an encoded object. The type and length are part of
+// it because a struct and its first field, or a slice and a shorter slice
+// of it, share an address.
+type objectKey struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+// valueKey indexes the values written under DedupValues by type and
+// content hash; values with the same key are compared with DeepEqual.
+type valueKey struct {
+	typ  reflect.Type
+	hash uint64
+}
+
+type cachedValue struct {
+	value reflect.Value
+	index int
+}
+
+// traitKey identifies the sealed traits written for a struct type.
+type traitKey struct {
+	typ     reflect.Type
+	class   string
+	reserve bool
 }
 
+// NilPolicy selects the encoding of a nil slice or map.
+type NilPolicy int
+
+const (
+	NilAsNull  NilPolicy = iota // null
+	NilAsEmpty                  // an empty array or object
+)
+
 /* ───── lifecycle ───── */
 
+// NewEncoder returns an encoder writing to w. The encoder does not buffer;
+// if w does, such as a *bufio.Writer, call Flush once values are encoded.
 func NewEncoder(w io.Writer, reservStruct bool) *Encoder {
 	e := &Encoder{writer: w, reservStruct: reservStruct}
 	e.Reset()
@@ -28,35 +148,202 @@ func NewEncoder(w io.Writer, reservStruct bool) *Encoder {
 }
 
 func (e *Encoder) Reset() {
-	e.objectCache = make(map[uintptr]int)
+	e.objectCache = make(map[objectKey]int)
+	e.objectCount = 0
 	e.stringCache = make(map[string]int)
+	e.stringList = nil
+	e.valueCache = make(map[valueKey][]cachedValue)
+	e.identities = make(map[interface{}]int)
+	e.traitCache = make(map[traitKey]int)
+	e.traits = nil
+	e.bytesWritten = 0
+	e.depth = 0
 }
 
-/* ───── helpers ───── */
+// Clone returns an encoder with a copy of e's options and reference
+// tables. Both write to the same writer.
+func (e *Encoder) Clone() *Encoder {
+	c := *e
+	c.stringCache = make(map[string]int, len(e.stringCache))
+	for k, v := range e.stringCache {
+		c.stringCache[k] = v
+	}
+	c.stringList = append([]string(nil), e.stringList...)
+	c.traits = append([]*traitInfo(nil), e.traits...)
+	c.objectCache = make(map[objectKey]int, len(e.objectCache))
+	for k, v := range e.objectCache {
+		c.objectCache[k] = v
+	}
+	c.valueCache = make(map[valueKey][]cachedValue, len(e.valueCache))
+	for k, v := range e.valueCache {
+		c.valueCache[k] = append([]cachedValue(nil), v...)
+	}
+	c.identities = make(map[interface{}]int, len(e.identities))
+	for k, v := range e.identities {
+		c.identities[k] = v
+	}
+	c.traitCache = make(map[traitKey]int, len(e.traitCache))
+	for k, v := range e.traitCache {
+		c.traitCache[k] = v
+	}
+	return &c
+}
 
-func (e *Encoder) getFieldName(f reflect.StructField) string {
-	r := []rune(f.Name)
-	if unicode.IsLower(r[0]) {
-		return ""
+// SetReserveStruct changes whether struct field names are written as
+// declared or with a lowercased first letter, as passed to NewEncoder. It
+// applies from the next value on and is kept across Reset.
+func (e *Encoder) SetReserveStruct(reserve bool) {
+	e.reservStruct = reserve
+}
+
+// BytesWritten returns the number of bytes written since the encoder was
+// created or last Reset.
+func (e *Encoder) BytesWritten() int64 {
+	return e.bytesWritten
+}
+
+// StringTable returns the strings written so far, in reference order.
+func (e *Encoder) StringTable() []string {
+	return append([]string(nil), e.stringList...)
+}
+
+// ObjectCount returns the number of entries in the object reference table.
+func (e *Encoder) ObjectCount() int {
+	return e.objectCount
+}
+
+// EncodeLengthPrefixed encodes v and writes it preceded by its length in
+// bytes, as an unsigned integer of prefixBytes, 2 or 4, in byteOrder. If
+// the body is too long for the prefix nothing is written, but the
+// reference tables have advanced, so the encoder should be Reset.
+func (e *Encoder) EncodeLengthPrefixed(v AMFAny, byteOrder binary.ByteOrder, prefixBytes int) error {
+	if prefixBytes != 2 && prefixBytes != 4 {
+		return errors.New("invalid length prefix size: " + strconv.Itoa(prefixBytes))
 	}
-	if tag := f.Tag.Get("amf.name"); tag != "" {
-		return tag
+	written := e.bytesWritten
+	body, err := e.EncodeFrame(v)
+	e.bytesWritten = written // the body is counted when written below
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, prefixBytes)
+	if prefixBytes == 2 {
+		if len(body) > math.MaxUint16 {
+			return errors.New("body of " + strconv.Itoa(len(body)) + " bytes exceeds a 2 byte length prefix")
+		}
+		byteOrder.PutUint16(prefix, uint16(len(body)))
+	} else {
+		if uint64(len(body)) > math.MaxUint32 {
+			return errors.New("body of " + strconv.Itoa(len(body)) + " bytes exceeds a 4 byte length prefix")
+		}
+		byteOrder.PutUint32(prefix, uint32(len(body)))
+	}
+	if err := e.writeBytes(prefix); err != nil {
+		return err
+	}
+	return e.writeBytes(body)
+}
+
+// Flush flushes the underlying writer if it buffers, such as a
+// *bufio.Writer, and does nothing otherwise.
+func (e *Encoder) Flush() error {
+	if f, ok := e.writer.(interface{ Flush() error }); ok {
+		return f.Flush()
 	}
-	if !e.reservStruct {
-		r[0] = unicode.ToLower(r[0])
-		return string(r)
+	return nil
+}
+
+// EncodeTo encodes v to w with a new encoder, flushing w if it buffers, and
+// returns the number of bytes written.
+func EncodeTo(w io.Writer, v AMFAny) (int64, error) {
+	e := NewEncoder(w, false)
+	if err := e.Encode(v); err != nil {
+		return e.bytesWritten, err
 	}
-	return f.Name
+	return e.bytesWritten, e.Flush()
+}
+
+// EncodedSize returns the number of bytes encoding v with a new encoder
+// would write, references included, without keeping the encoding.
+func EncodedSize(v AMFAny, reservStruct bool) (int, error) {
+	e := NewEncoder(io.Discard, reservStruct)
+	err := e.Encode(v)
+	return int(e.bytesWritten), err
+}
+
+// EncodeJSON reads a JSON value from r and writes it to w as amf3, for
+// scripting payloads. Objects become anonymous objects and arrays strict
+// arrays. A number is written as an integer when it is integral and in
+// the range Encode writes integers in, otherwise as a double.
+func EncodeJSON(r io.Reader, w io.Writer) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var v AMFAny
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	e := NewEncoder(w, false)
+	if err := e.Encode(fromJSON(v)); err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// fromJSON replaces the json.Numbers in v with an int64 or float64.
+func fromJSON(v AMFAny) AMFAny {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil && isInteger(n) {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, elem := range v {
+			v[k] = fromJSON(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = fromJSON(elem)
+		}
+	}
+	return v
+}
+
+/* ───── helpers ───── */
+
+// fieldName returns the name field f is written under, or "" to skip it.
+func (e *Encoder) fieldName(f *fieldInfo) string {
+	switch {
+	case !f.exported:
+		return ""
+	case e.reservStruct || f.preserve:
+		return f.name
+	}
+	return f.lowerName
 }
 
 func (e *Encoder) writeBytes(b []byte) error {
-	if n, err := e.writer.Write(b); n != len(b) || err != nil {
+	n, err := e.writer.Write(b)
+	e.bytesWritten += int64(n)
+	if n != len(b) || err != nil {
 		return errors.New("write failed")
 	}
 	return nil
 }
 
-func (e *Encoder) writeMarker(m byte) error { return e.writeBytes([]byte{m}) }
+func (e *Encoder) writeMarker(m byte) error {
+	e.trace(m)
+	return e.writeBytes([]byte{m})
+}
+
+// trace reports a value about to be written to OnWrite.
+func (e *Encoder) trace(m byte) {
+	if e.OnWrite != nil {
+		e.OnWrite(m, e.depth)
+	}
+}
 
 /* ───── primitive encoders ───── */
 
@@ -70,8 +357,11 @@ func (e *Encoder) encodeBool(v bool) error {
 func (e *Encoder) encodeNull() error { return e.writeMarker(NULL_MARKER) }
 
 func (e *Encoder) encodeUint(v uint64) error {
-	if v >= 0x20000000 {
-		if v <= 0xffffffff {
+	if e.AllNumbersAsDouble {
+		return e.encodeFloat(float64(v))
+	}
+	if v >= 0x10000000 { // read back as negative as a 29-bit integer
+		if v <= maxExactDouble {
 			return e.encodeFloat(float64(v))
 		}
 		return e.encodeString(strconv.FormatUint(v, 10))
@@ -83,8 +373,11 @@ func (e *Encoder) encodeUint(v uint64) error {
 }
 
 func (e *Encoder) encodeInt(v int64) error {
-	if v < -0x0fffffff {
-		if v > -0x7fffffff {
+	if e.AllNumbersAsDouble {
+		return e.encodeFloat(float64(v))
+	}
+	if !isInteger(v) {
+		if v >= -maxExactDouble && v <= maxExactDouble {
 			return e.encodeFloat(float64(v))
 		}
 		return e.encodeString(strconv.FormatInt(v, 10))
@@ -92,11 +385,22 @@ func (e *Encoder) encodeInt(v int64) error {
 	if err := e.writeMarker(INTEGER_MARKER); err != nil {
 		return err
 	}
-	return e.writeU29(uint32(v))
+	return e.writeU29(uint32(v) & 0x1fffffff) // 29-bit two's complement
+}
+
+// maxExactDouble is 2^53, past which not every integer is a double, so
+// larger integers are written as strings.
+const maxExactDouble = 1 << 53
+
+// isInteger reports whether v is written with the integer marker, that is
+// whether it fits a 29-bit signed integer, -2^28 to 2^28-1.
+func isInteger(v int64) bool {
+	return v >= -0x10000000 && v <= 0x0fffffff
 }
 
 func (e *Encoder) encodeFloat(v float64) error {
 	buf := make([]byte, 9)
+	e.trace(DOUBLE_MARKER)
 	buf[0] = DOUBLE_MARKER
 	u := math.Float64bits(v)
 	for i := 8; i > 0; i-- {
@@ -113,35 +417,160 @@ func (e *Encoder) encodeString(s string) error {
 	return e.writeString(s)
 }
 
+func (e *Encoder) encodeText(m encoding.TextMarshaler) error {
+	text, err := m.MarshalText()
+	if err != nil {
+		return err
+	}
+	return e.encodeString(string(text))
+}
+
 /* ───── compound encoders ───── */
 
+// writeReference writes an object reference if v has been encoded before,
+// otherwise it registers v in the object table. It reports whether a
+// reference was written.
+func (e *Encoder) writeReference(v reflect.Value) (bool, error) {
+	key := objectKey{ptr: v.Pointer(), typ: v.Type()}
+	if v.Kind() == reflect.Slice {
+		key.len = v.Len()
+	}
+	if idx, ok := e.objectCache[key]; ok {
+		return true, e.writeU29(uint32(idx << 1))
+	}
+	var id interface{}
+	hasID := false
+	if e.IdentityFunc != nil {
+		if id, hasID = e.IdentityFunc(v); hasID {
+			if idx, ok := e.identities[id]; ok {
+				return true, e.writeU29(uint32(idx << 1))
+			}
+		}
+	}
+	var vkey valueKey
+	if e.DedupValues {
+		vkey = valueKey{v.Type(), hashValue(fnvOffset, v, maxHashDepth)}
+		for _, c := range e.valueCache[vkey] {
+			if reflect.DeepEqual(c.value.Interface(), v.Interface()) {
+				return true, e.writeU29(uint32(c.index << 1))
+			}
+		}
+	}
+
+	// nil maps and slices all share pointer 0, so they are never cached
+	idx := e.objectCount
+	e.objectCount++
+	if !v.IsNil() {
+		e.objectCache[key] = idx
+	}
+	if hasID {
+		e.identities[id] = idx
+	}
+	if e.DedupValues {
+		e.valueCache[vkey] = append(e.valueCache[vkey], cachedValue{v, idx})
+	}
+	return false, nil
+}
+
+const (
+	fnvOffset    = 14695981039346656037
+	fnvPrime     = 1099511628211
+	maxHashDepth = 8 // pointers deeper than this are not followed
+)
+
+// hashValue mixes the content of v into h, FNV-1a style, so that values
+// reflect.DeepEqual considers equal hash alike. Map entries are combined
+// regardless of order; pointers are followed up to depth levels, which
+// also ends cycles.
+func hashValue(h uint64, v reflect.Value, depth int) uint64 {
+	mix := func(h, x uint64) uint64 { return (h ^ x) * fnvPrime }
+	h = mix(h, uint64(v.Kind()))
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			h = mix(h, 1)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		h = mix(h, uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		h = mix(h, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		if f := v.Float(); f != 0 { // -0 equals 0
+			h = mix(h, math.Float64bits(f))
+		}
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		h = hashValue(h, reflect.ValueOf(real(c)), depth)
+		h = hashValue(h, reflect.ValueOf(imag(c)), depth)
+	case reflect.String:
+		s := v.String()
+		for i := 0; i < len(s); i++ {
+			h = mix(h, uint64(s[i]))
+		}
+	case reflect.Slice, reflect.Array:
+		h = mix(h, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			h = hashValue(h, v.Index(i), depth)
+		}
+	case reflect.Map:
+		h = mix(h, uint64(v.Len()))
+		var sum uint64
+		for it := v.MapRange(); it.Next(); {
+			sum += hashValue(hashValue(fnvOffset, it.Key(), depth), it.Value(), depth)
+		}
+		h = mix(h, sum)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			h = hashValue(h, v.Field(i), depth)
+		}
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() && depth > 0 {
+			h = hashValue(h, v.Elem(), depth-1)
+		}
+	}
+	return h
+}
+
 func (e *Encoder) encodeMap(v reflect.Value) error {
+	if v.IsNil() && e.NilMap == NilAsNull {
+		return e.encodeNull()
+	}
 	if err := e.writeMarker(OBJECT_MARKER); err != nil {
 		return err
 	}
 
-	if idx, ok := e.objectCache[v.Pointer()]; ok {
-		return e.writeU29(uint32(idx << 2)) // ((idx<<1)|1)<<1
-	}
-	e.objectCache[v.Pointer()] = len(e.objectCache)
-
-	// dynamic object flag
-	if err := e.writeMarker(0x0b); err != nil {
+	if ok, err := e.writeReference(v); ok || err != nil {
 		return err
 	}
-	if err := e.writeString(""); err != nil {
+	e.depth++
+	defer func() { e.depth-- }()
+
+	if err := e.writeTraits("", nil, true); err != nil {
 		return err
 	}
 
-	for _, k := range v.MapKeys() {
-		if k.Kind() != reflect.String {
-			return errors.New("map key must be string")
+	keys := v.MapKeys()
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		name, err := mapKeyString(k)
+		if err != nil {
+			return err
 		}
-		if err := e.writeString(k.String()); err != nil {
+		names[i] = name
+	}
+	if e.Deterministic || e.SortMapKeys {
+		sort.Sort(byKeyName{keys, names})
+	}
+	for i, k := range keys {
+		if err := e.writeString(names[i]); err != nil {
 			return err
 		}
 
 		elem := v.MapIndex(k)
+		if e.FlattenSingleElementSlices && elem.Kind() == reflect.Slice &&
+			elem.Type().Elem().Kind() == reflect.String && elem.Len() == 1 {
+			elem = elem.Index(0)
+		}
 
 		// Map elements are never addressable; if it's a struct, always copy it into
 		// an addressable wrapper so downstream code can take its address safely.
@@ -157,35 +586,135 @@ func (e *Encoder) encodeMap(v reflect.Value) error {
 	return e.writeString("") // end-of-object marker
 }
 
-func (e *Encoder) encodeStruct(v reflect.Value) error {
+// encodeSyncMap encodes the *sync.Map v as an anonymous object, like a
+// map. Its keys must be strings.
+func (e *Encoder) encodeSyncMap(v reflect.Value) error {
 	if err := e.writeMarker(OBJECT_MARKER); err != nil {
 		return err
 	}
+	if ok, err := e.writeReference(v); ok || err != nil {
+		return err
+	}
+	e.depth++
+	defer func() { e.depth-- }()
 
-	if idx, ok := e.objectCache[v.Pointer()]; ok {
-		return e.writeU29(uint32(idx << 2))
+	if err := e.writeTraits("", nil, true); err != nil {
+		return err
 	}
-	e.objectCache[v.Pointer()] = len(e.objectCache)
 
-	if err := e.writeMarker(0x0b); err != nil {
+	var names []string
+	values := make(map[string]AMFAny)
+	var err error
+	v.Interface().(*sync.Map).Range(func(k, elem interface{}) bool {
+		name, ok := k.(string)
+		if !ok {
+			err = errors.New("sync.Map key must be string")
+			return false
+		}
+		names = append(names, name)
+		values[name] = elem
+		return true
+	})
+	if err != nil {
 		return err
 	}
-	if err := e.writeString(""); err != nil { // dynamic
+	if e.Deterministic || e.SortMapKeys {
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		if err := e.writeString(name); err != nil {
+			return err
+		}
+		elem := values[name]
+		if err := e.encode(reflect.ValueOf(&elem).Elem()); err != nil {
+			return err
+		}
+	}
+	return e.writeString("")
+}
+
+// mapKeyString returns the object key map key k is written as. Integer
+// keys are written in decimal.
+func mapKeyString(k reflect.Value) (string, error) {
+	switch k.Kind() {
+	case reflect.String:
+		return k.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", errors.New("map key must be string or integer")
+}
+
+// byKeyName sorts map keys by the names they are written as.
+type byKeyName struct {
+	keys  []reflect.Value
+	names []string
+}
+
+func (s byKeyName) Len() int           { return len(s.keys) }
+func (s byKeyName) Less(i, j int) bool { return s.names[i] < s.names[j] }
+func (s byKeyName) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+}
+
+func (e *Encoder) encodeStruct(v reflect.Value) error {
+	if err := e.writeMarker(OBJECT_MARKER); err != nil {
 		return err
 	}
 
+	if ok, err := e.writeReference(v); ok || err != nil {
+		return err
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+
 	sv := v.Elem()
 	st := sv.Type()
-	for i := 0; i < st.NumField(); i++ {
-		f := st.Field(i)
-		name := e.getFieldName(f)
-		if name == "" {
+	class := ""
+	if e.UseTypeNameAsClass {
+		class = registeredName(st)
+	}
+
+	si := cachedStructInfo(st)
+	fields := si.fields
+	if e.Deterministic {
+		fields = append([]fieldInfo(nil), fields...)
+		sort.SliceStable(fields, func(i, j int) bool {
+			return e.fieldName(&fields[i]) < e.fieldName(&fields[j])
+		})
+	}
+	var names []string
+	for i := range fields {
+		names = append(names, e.fieldName(&fields[i]))
+	}
+
+	if e.SealedStructMembers {
+		if err := e.writeSealedTraits(st, class, names); err != nil {
+			return err
+		}
+	} else if err := e.writeTraits(class, nil, true); err != nil {
+		return err
+	}
+	for i := range fields {
+		f := &fields[i]
+		if names[i] == "" {
 			continue
 		}
-		if err := e.writeString(name); err != nil {
-			return err
+		if !e.SealedStructMembers {
+			if err := e.writeString(names[i]); err != nil {
+				return err
+			}
+		}
+		fv := sv.Field(f.index)
+		if f.discriminator && fv.Kind() == reflect.String {
+			if err := e.encodeString(registeredName(st)); err != nil {
+				return err
+			}
+			continue
 		}
-		fv := sv.Field(i)
 		if fv.Kind() == reflect.Struct {
 			fv = fv.Addr()
 		}
@@ -193,18 +722,66 @@ func (e *Encoder) encodeStruct(v reflect.Value) error {
 			return err
 		}
 	}
+	if e.SealedStructMembers {
+		return nil
+	}
 	return e.writeString("")
 }
 
+// writeTraits writes inline traits with the sealed member names and class,
+// which take the next slot in the traits table.
+func (e *Encoder) writeTraits(class string, sealed []string, dynamic bool) error {
+	header := uint32(len(sealed))<<4 | 0x03
+	if dynamic {
+		header |= 0x08
+	}
+	if err := e.writeU29(header); err != nil {
+		return err
+	}
+	e.traits = append(e.traits, &traitInfo{class, sealed, dynamic})
+	if err := e.writeString(class); err != nil {
+		return err
+	}
+	for _, name := range sealed {
+		if err := e.writeString(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSealedTraits writes the traits of struct type t, with the non-empty
+// names as sealed members, or a reference to them if written before.
+func (e *Encoder) writeSealedTraits(t reflect.Type, class string, names []string) error {
+	key := traitKey{t, class, e.reservStruct}
+	if idx, ok := e.traitCache[key]; ok && !e.Deterministic {
+		return e.writeU29(uint32(idx)<<2 | 0x01)
+	}
+	var sealed []string
+	for _, name := range names {
+		if name != "" {
+			sealed = append(sealed, name)
+		}
+	}
+	if !e.Deterministic {
+		e.traitCache[key] = len(e.traits)
+	}
+	return e.writeTraits(class, sealed, false)
+}
+
 func (e *Encoder) encodeSlice(v reflect.Value) error {
+	if v.IsNil() && e.NilSlice == NilAsNull {
+		return e.encodeNull()
+	}
 	if err := e.writeMarker(ARRAY_MARKER); err != nil {
 		return err
 	}
 
-	if idx, ok := e.objectCache[v.Pointer()]; ok {
-		return e.writeU29(uint32(idx << 2))
+	if ok, err := e.writeReference(v); ok || err != nil {
+		return err
 	}
-	e.objectCache[v.Pointer()] = len(e.objectCache)
+	e.depth++
+	defer func() { e.depth-- }()
 
 	if err := e.writeU29(uint32(v.Len())<<1 | 0x01); err != nil {
 		return err
@@ -213,6 +790,26 @@ func (e *Encoder) encodeSlice(v reflect.Value) error {
 		return err
 	}
 
+	// large numeric arrays skip the per-element reflection
+	if v.CanInterface() {
+		switch s := v.Interface().(type) {
+		case []float64:
+			for _, f := range s {
+				if err := e.encodeFloat(f); err != nil {
+					return err
+				}
+			}
+			return nil
+		case []int32:
+			for _, n := range s {
+				if err := e.encodeInt(int64(n)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
 	for i := 0; i < v.Len(); i++ {
 		elem := v.Index(i)
 		if elem.Kind() == reflect.Struct {
@@ -225,15 +822,175 @@ func (e *Encoder) encodeSlice(v reflect.Value) error {
 	return nil
 }
 
+func (e *Encoder) encodeByteArray(v reflect.Value) error {
+	if v.IsNil() && e.NilSlice == NilAsNull {
+		return e.encodeNull()
+	}
+	if err := e.writeMarker(BYTEARRAY_MARKER); err != nil {
+		return err
+	}
+
+	if ok, err := e.writeReference(v); ok || err != nil {
+		return err
+	}
+
+	if err := e.writeU29(uint32(v.Len())<<1 | 0x01); err != nil {
+		return err
+	}
+	return e.writeBytes(v.Bytes())
+}
+
+// encodeDate writes t as a date, milliseconds since the Unix epoch in UTC;
+// amf3 dates carry no timezone.
+func (e *Encoder) encodeDate(t time.Time) error {
+	if err := e.writeMarker(DATE_MARKER); err != nil {
+		return err
+	}
+	e.objectCount++ // never referenced, but takes a slot
+	if err := e.writeU29(0x01); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, math.Float64bits(float64(t.UnixMilli())))
+	return e.writeBytes(buf)
+}
+
+// encodeComplex writes c as an anonymous object with real and imag members.
+func (e *Encoder) encodeComplex(c complex128) error {
+	if err := e.writeMarker(OBJECT_MARKER); err != nil {
+		return err
+	}
+	e.objectCount++ // never referenced, but takes a slot
+	if err := e.writeTraits("", nil, true); err != nil {
+		return err
+	}
+	if err := e.writeString("real"); err != nil {
+		return err
+	}
+	if err := e.encodeFloat(real(c)); err != nil {
+		return err
+	}
+	if err := e.writeString("imag"); err != nil {
+		return err
+	}
+	if err := e.encodeFloat(imag(c)); err != nil {
+		return err
+	}
+	return e.writeString("")
+}
+
+// EncodeECMAArray writes an array with both a dense and an associative
+// portion, for peers that require that form. Decoding it into a string
+// keyed map, or an interface, yields the associative members plus the
+// dense elements keyed by index.
+func (e *Encoder) EncodeECMAArray(dense []AMFAny, assoc map[string]AMFAny) error {
+	if err := e.writeMarker(ARRAY_MARKER); err != nil {
+		return err
+	}
+	e.objectCount++ // never referenced, but takes a slot
+	e.depth++
+	defer func() { e.depth-- }()
+
+	if err := e.writeU29(uint32(len(dense))<<1 | 0x01); err != nil {
+		return err
+	}
+	for k, v := range assoc {
+		if k == "" {
+			return errors.New("empty key in associative array")
+		}
+		if err := e.writeString(k); err != nil {
+			return err
+		}
+		if err := e.encode(reflect.ValueOf(v)); err != nil {
+			return err
+		}
+	}
+	if err := e.writeString(""); err != nil { // end of associative part
+		return err
+	}
+	for _, v := range dense {
+		if err := e.encode(reflect.ValueOf(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeTuple writes the struct held by v as a dense array of its fields.
+func (e *Encoder) encodeTuple(v reflect.Value) error {
+	for v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Invalid:
+		return e.encodeNull()
+	case reflect.Ptr:
+		if v.IsNil() {
+			return e.encodeNull()
+		}
+	case reflect.Struct:
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		v = ptr
+	}
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return errors.New("invalid type: " + v.Type().String() + " for tuple")
+	}
+
+	if err := e.writeMarker(ARRAY_MARKER); err != nil {
+		return err
+	}
+	if ok, err := e.writeReference(v); ok || err != nil {
+		return err
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+
+	sv := v.Elem()
+	fields := tupleFields(sv.Type())
+	if err := e.writeU29(uint32(len(fields))<<1 | 0x01); err != nil {
+		return err
+	}
+	if err := e.writeString(""); err != nil { // no ECMA part
+		return err
+	}
+	for _, i := range fields {
+		fv := sv.Field(i)
+		if fv.Kind() == reflect.Struct {
+			fv = fv.Addr()
+		}
+		if err := e.encode(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 /* ───── dispatcher ───── */
 
 func (e *Encoder) encode(v reflect.Value) error {
+	if v.IsValid() && v.Type() == timeType {
+		return e.encodeDate(v.Interface().(time.Time))
+	}
+	if v.IsValid() && v.Kind() != reflect.Interface && v.Kind() != reflect.Ptr &&
+		v.Type().Implements(textMarshalerType) {
+		return e.encodeText(v.Interface().(encoding.TextMarshaler))
+	}
+	if v.IsValid() && v.Kind() != reflect.Interface && !(v.Kind() == reflect.Ptr && v.IsNil()) &&
+		v.Type().Implements(errorType) && !v.Type().Implements(textMarshalerType) {
+		// such as an error in a slice of rpc results
+		return e.encodeString(v.Interface().(error).Error())
+	}
+
 	switch v.Kind() {
 	case reflect.Map:
 		return e.encodeMap(v)
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return e.encodeUint(v.Uint())
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Type() == decimalType {
+			return e.encodeFloat(float64(v.Int()) / 100)
+		}
 		return e.encodeInt(v.Int())
 	case reflect.Bool:
 		return e.encodeBool(v.Bool())
@@ -242,37 +999,159 @@ func (e *Encoder) encode(v reflect.Value) error {
 	case reflect.Array:
 		return e.encodeSlice(v.Slice(0, v.Len()))
 	case reflect.Slice:
+		if v.Type() == rawMessageType {
+			if v.Len() == 0 {
+				return e.encodeNull()
+			}
+			e.trace(v.Bytes()[0])
+			return e.writeRaw(v.Bytes())
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Type().Implements(stringerType) && !e.StringersAsByteArray {
+				return e.encodeString(v.Interface().(fmt.Stringer).String())
+			}
+			return e.encodeByteArray(v)
+		}
 		return e.encodeSlice(v)
 	case reflect.Float32, reflect.Float64:
 		return e.encodeFloat(v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		return e.encodeComplex(v.Complex())
 	case reflect.Interface:
-		return e.encode(reflect.ValueOf(v.Interface()))
+		if v.IsNil() {
+			return e.encodeNull()
+		}
+		return e.encode(v.Elem())
+	case reflect.Struct:
+		if v.Type() == tupleType {
+			return e.encodeTuple(v.Field(0))
+		}
+		if v.CanAddr() {
+			return e.encode(v.Addr())
+		}
+		// a struct passed or held by value is not addressable; encode a copy
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		return e.encode(ptr)
+	case reflect.Invalid: // untyped nil
+		return e.encodeNull()
 	case reflect.Ptr:
 		if v.IsNil() {
 			return e.encodeNull()
 		}
+		switch v.Elem().Type() {
+		case tupleType:
+			return e.encode(v.Elem())
+		case timeType:
+			return e.encodeDate(*v.Interface().(*time.Time))
+		case urlType:
+			return e.encodeString(v.Interface().(*url.URL).String())
+		case syncMapType:
+			return e.encodeSyncMap(v)
+		case bigIntType:
+			if n := v.Interface().(*big.Int); n.IsInt64() {
+				return e.encodeInt(n.Int64())
+			}
+			return e.encodeString(v.Interface().(*big.Int).String())
+		case bigFloatType:
+			// a double only when exact, keeping the digits of a
+			// high-precision value in its decimal string
+			f := v.Interface().(*big.Float)
+			if x, acc := f.Float64(); acc == big.Exact {
+				return e.encodeFloat(x)
+			}
+			return e.encodeString(f.Text('g', -1))
+		}
+		if v.Type().Implements(textMarshalerType) {
+			return e.encodeText(v.Interface().(encoding.TextMarshaler))
+		}
 		if v.Elem().Kind() == reflect.Struct {
 			return e.encodeStruct(v)
 		}
 		return e.encode(v.Elem())
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		if e.UnsupportedAsNull && v.IsNil() {
+			return e.encodeNull()
+		}
+		fallthrough
 	default:
-		return errors.New("unsupported type: " + v.Type().String())
+		return errors.New("unsupported type: " + v.Type().String() + ", " +
+			v.Kind().String() + " values have no amf representation")
 	}
 }
 
-func (e *Encoder) Encode(v AMFAny) error { return e.encode(reflect.ValueOf(v)) }
+func (e *Encoder) Encode(v AMFAny) error {
+	// common concrete types bypass reflection
+	switch v := v.(type) {
+	case string:
+		return e.encodeString(v)
+	case bool:
+		return e.encodeBool(v)
+	case float64:
+		return e.encodeFloat(v)
+	}
+	return e.encode(reflect.ValueOf(v))
+}
+
+// EncodeValue encodes the value held by v, like Encode without boxing it
+// in an interface first.
+func (e *Encoder) EncodeValue(v reflect.Value) error { return e.encode(v) }
+
+// EncodeFrame encodes values one after another and returns the bytes of the
+// complete message, such as an RTMP command payload, instead of writing
+// them. The reference tables are shared with the stream encoding.
+func (e *Encoder) EncodeFrame(values ...AMFAny) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := e.writer
+	e.writer = &buf
+	defer func() { e.writer = writer }()
+
+	for _, v := range values {
+		if err := e.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
 
 /* ───── low-level helpers ───── */
 
+// writeRaw writes the encoding of a RawMessage after scanning it for the
+// strings, objects and traits it introduces, which take their slots in the
+// reference tables as they do when decoded.
+func (e *Encoder) writeRaw(b []byte) error {
+	d := NewDecoder(bytes.NewReader(b))
+	d.MaxCollectionLen = 0
+	d.stringCache = append(d.stringCache, e.stringList...)
+	d.objectCache = make([]objectEntry, e.objectCount)
+	d.traitCache = append(d.traitCache, e.traits...)
+	if err := d.walk(); err != nil {
+		return errors.New("invalid RawMessage: " + err.Error())
+	}
+
+	if !e.Deterministic {
+		for _, s := range d.stringCache[len(e.stringList):] {
+			if _, ok := e.stringCache[s]; !ok {
+				e.stringCache[s] = len(e.stringList)
+			}
+			e.stringList = append(e.stringList, s)
+		}
+	}
+	e.objectCount = len(d.objectCache)
+	e.traits = d.traitCache
+	return e.writeBytes(b)
+}
+
 func (e *Encoder) writeString(s string) error {
-	if idx, ok := e.stringCache[s]; ok {
+	if idx, ok := e.stringCache[s]; ok && !e.Deterministic {
 		return e.writeU29(uint32(idx << 1))
 	}
 	if err := e.writeU29(uint32(len(s)<<1 | 0x01)); err != nil {
 		return err
 	}
-	if s != "" {
-		e.stringCache[s] = len(e.stringCache)
+	if s != "" && !e.Deterministic {
+		e.stringCache[s] = len(e.stringList)
+		e.stringList = append(e.stringList, s)
 	}
 	return e.writeBytes([]byte(s))
 }
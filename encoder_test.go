@@ -0,0 +1,1153 @@
+// Copyright 2011 baihaoping@gmail.com.
+// BSD-style license; see LICENSE file.
+
+package amf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// float64s has the shape of []float64 but not its type, so it is encoded
+// element by element through reflection.
+type float64s []float64
+
+func telemetry(n int) []float64 {
+	s := make([]float64, n)
+	for i := range s {
+		s[i] = float64(i) * 0.25
+	}
+	return s
+}
+
+func TestEncodeFloat64SliceFastPath(t *testing.T) {
+	s := telemetry(1000)
+	if fast, slow := encode(t, s), encode(t, float64s(s)); !bytes.Equal(fast, slow) {
+		t.Error("fast path encoding differs from reflection")
+	}
+}
+
+func BenchmarkEncodeFloat64Slice(b *testing.B) {
+	s := telemetry(100000)
+	for _, bm := range []struct {
+		name string
+		v    AMFAny
+	}{
+		{"reflect", float64s(s)},
+		{"fast", s},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			e := NewEncoder(io.Discard, false)
+			for i := 0; i < b.N; i++ {
+				e.Reset()
+				if err := e.Encode(bm.v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+type sharedFoo struct {
+	Name string
+}
+
+func TestInterfaceFieldSharesReference(t *testing.T) {
+	foo := &sharedFoo{Name: "foo"}
+	for _, v := range []AMFAny{
+		&struct {
+			Direct *sharedFoo
+			Any    AMFAny
+		}{foo, foo},
+		&struct {
+			Any    AMFAny
+			Direct *sharedFoo
+		}{foo, foo},
+	} {
+		e := NewEncoder(io.Discard, false)
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if n := e.ObjectCount(); n != 2 {
+			t.Errorf("%T: %d objects written, want 2", v, n)
+		}
+	}
+
+	var out struct {
+		Direct *sharedFoo
+		Any    AMFAny
+	}
+	data := encode(t, &struct {
+		Direct *sharedFoo
+		Any    AMFAny
+	}{foo, foo})
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := out.Any.(*sharedFoo); !ok || p != out.Direct || p.Name != "foo" {
+		t.Errorf("got %+v, want the same *sharedFoo twice", out)
+	}
+}
+
+func TestIntegerEncodingBoundaries(t *testing.T) {
+	tests := []struct {
+		v      AMFAny
+		marker byte
+	}{
+		{int64(0x0fffffff), INTEGER_MARKER},
+		{int64(0x10000000), DOUBLE_MARKER},
+		{int64(-0x10000000), INTEGER_MARKER},
+		{int64(-0x10000001), DOUBLE_MARKER},
+		{int64(1 << 53), DOUBLE_MARKER},
+		{int64(1<<53 + 1), STRING_MARKER},
+		{int64(-1 << 53), DOUBLE_MARKER},
+		{int64(-1<<53 - 1), STRING_MARKER},
+		{uint64(0x0fffffff), INTEGER_MARKER},
+		{uint64(0x10000000), DOUBLE_MARKER},
+		{uint64(1 << 53), DOUBLE_MARKER},
+		{uint64(1<<53 + 1), STRING_MARKER},
+		{int(1 << 30), DOUBLE_MARKER},
+		{uint(1 << 30), DOUBLE_MARKER},
+	}
+	for _, tt := range tests {
+		data := encode(t, tt.v)
+		if data[0] != tt.marker {
+			t.Errorf("%T %v: marker %#x, want %#x", tt.v, tt.v, data[0], tt.marker)
+		}
+		back := reflect.New(reflect.TypeOf(tt.v))
+		if err := NewDecoder(bytes.NewReader(data)).Decode(back.Interface()); err != nil || back.Elem().Interface() != tt.v {
+			t.Errorf("%T %v: got %v, %v", tt.v, tt.v, back.Elem(), err)
+		}
+	}
+}
+
+func TestHardwareAddrRoundTrip(t *testing.T) {
+	mac, _ := net.ParseMAC("00:1a:2b:3c:4d:5e")
+	for _, asBytes := range []bool{false, true} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf, false)
+		e.StringersAsByteArray = asBytes
+		if err := e.Encode(mac); err != nil {
+			t.Fatal(err)
+		}
+		marker := byte(STRING_MARKER)
+		if asBytes {
+			marker = BYTEARRAY_MARKER
+		}
+		if buf.Bytes()[0] != marker {
+			t.Errorf("StringersAsByteArray %v: marker %#x, want %#x", asBytes, buf.Bytes()[0], marker)
+		}
+		var back net.HardwareAddr
+		if err := NewDecoder(&buf).Decode(&back); err != nil || back.String() != mac.String() {
+			t.Errorf("StringersAsByteArray %v: got %v, %v", asBytes, back, err)
+		}
+	}
+}
+
+type dedupItem struct {
+	Name string
+	Tags []string
+	Attr map[string]int
+}
+
+func TestDedupValues(t *testing.T) {
+	items := []*dedupItem{
+		{"a", []string{"x"}, map[string]int{"k": 1, "l": 2}},
+		{"a", []string{"x"}, map[string]int{"l": 2, "k": 1}},
+		{"b", []string{"x"}, map[string]int{"k": 1, "l": 2}},
+	}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	e.DedupValues = true
+	if err := e.Encode(items); err != nil {
+		t.Fatal(err)
+	}
+	// the array, the first item with its slice and map, and the third item,
+	// which shares those two
+	if n := e.ObjectCount(); n != 5 {
+		t.Errorf("%d objects written, want 5", n)
+	}
+
+	var back []*dedupItem
+	if err := NewDecoder(&buf).Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	if back[0] != back[1] || back[0] == back[2] || !reflect.DeepEqual(back[2], items[2]) {
+		t.Errorf("got %+v, %+v, %+v", back[0], back[1], back[2])
+	}
+}
+
+func BenchmarkDedupValues(b *testing.B) {
+	items := make([]*dedupItem, 5000)
+	for i := range items {
+		items[i] = &dedupItem{Name: strconv.Itoa(i)}
+	}
+	e := NewEncoder(io.Discard, false)
+	e.DedupValues = true
+	for i := 0; i < b.N; i++ {
+		e.Reset()
+		if err := e.Encode(items); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var out bytes.Buffer
+	w := bufio.NewWriter(&out)
+	e := NewEncoder(w, false)
+	if err := e.Encode("hello"); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("%d bytes written before Flush", out.Len())
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := encode(t, "hello"); !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("after Flush: got % x, want % x", out.Bytes(), want)
+	}
+
+	// a writer without Flush is left alone
+	if err := NewEncoder(io.Discard, false).Flush(); err != nil {
+		t.Errorf("Flush on an unbuffered writer: %v", err)
+	}
+}
+
+func TestRawMessageStringReference(t *testing.T) {
+	raw := RawMessage(encode(t, "hello"))
+	data := encode(t, []AMFAny{raw, "hello"})
+	want := []byte{ARRAY_MARKER, 0x05, 0x01, STRING_MARKER, 0x0b, 'h', 'e', 'l', 'l', 'o', STRING_MARKER, 0x00}
+	if !bytes.Equal(data, want) {
+		t.Errorf("got % x, want % x", data, want)
+	}
+
+	var v []AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil || !reflect.DeepEqual(v, []AMFAny{"hello", "hello"}) {
+		t.Errorf("got %#v, %v", v, err)
+	}
+}
+
+func TestBigNumberRoundTrip(t *testing.T) {
+	type amounts struct {
+		Int   *big.Int   `amf.name:"int"`
+		Float *big.Float `amf.name:"float"`
+	}
+	n, _ := new(big.Int).SetString("340282366920938463463374607431768211455", 10) // 2^128-1
+	f, _ := new(big.Float).SetPrec(200).SetString("3.14159265358979323846264338327950288419716939937510")
+	data := encode(t, &amounts{n, f})
+
+	var back amounts
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Int == nil || back.Int.Cmp(n) != 0 {
+		t.Errorf("int: got %v, want %v", back.Int, n)
+	}
+	if back.Float == nil || back.Float.Text('g', -1) != f.Text('g', -1) {
+		t.Errorf("float: got %v, want %v", back.Float, f.Text('g', -1))
+	}
+
+	// exactly representable floats are doubles
+	var v AMFAny
+	if err := NewDecoder(bytes.NewReader(encode(t, big.NewFloat(0.5)))).Decode(&v); err != nil || v != 0.5 {
+		t.Errorf("0.5: got %#v, %v", v, err)
+	}
+}
+
+func TestUnsupportedAsNull(t *testing.T) {
+	type events struct {
+		Name string   `amf.name:"name"`
+		Done chan int `amf.name:"done"`
+	}
+	v := &events{Name: "x"}
+	err := NewEncoder(io.Discard, false).Encode(v)
+	if want := "unsupported type: chan int, chan values have no amf representation"; err == nil || err.Error() != want {
+		t.Errorf("default: got %v, want %q", err, want)
+	}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	e.UnsupportedAsNull = true
+	if err := e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	var back map[string]AMFAny
+	if err := NewDecoder(&buf).Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]AMFAny{"name": "x", "done": nil}; !reflect.DeepEqual(back, want) {
+		t.Errorf("got %#v, want %#v", back, want)
+	}
+
+	if err := e.Encode(&events{Done: make(chan int)}); err == nil {
+		t.Error("non-nil chan encoded")
+	}
+}
+
+func TestNilPolicies(t *testing.T) {
+	type lists struct {
+		Tags  []string       `amf.name:"tags"`
+		Attrs map[string]int `amf.name:"attrs"`
+	}
+	for _, tc := range []struct {
+		slice, m    NilPolicy
+		tags, attrs AMFAny
+	}{
+		{NilAsNull, NilAsNull, nil, nil},
+		{NilAsEmpty, NilAsNull, []AMFAny{}, nil},
+		{NilAsNull, NilAsEmpty, nil, map[string]AMFAny{}},
+		{NilAsEmpty, NilAsEmpty, []AMFAny{}, map[string]AMFAny{}},
+	} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf, false)
+		e.NilSlice, e.NilMap = tc.slice, tc.m
+		if err := e.Encode(&lists{}); err != nil {
+			t.Fatal(err)
+		}
+		var back map[string]AMFAny
+		if err := NewDecoder(&buf).Decode(&back); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(back["tags"], tc.tags) || !reflect.DeepEqual(back["attrs"], tc.attrs) {
+			t.Errorf("NilSlice %d, NilMap %d: got %#v", tc.slice, tc.m, back)
+		}
+	}
+}
+
+func TestURLRoundTrip(t *testing.T) {
+	type link struct {
+		Href *url.URL `amf.name:"href"`
+		Base url.URL  `amf.name:"base"`
+		None *url.URL `amf.name:"none"`
+	}
+	href, _ := url.Parse("https://example.com/a?b=c#d")
+	base, _ := url.Parse("rtmp://media.example.com:1935/live")
+	data := encode(t, &link{Href: href, Base: *base})
+
+	var raw map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&raw); err != nil || raw["href"] != href.String() {
+		t.Errorf("href encoded as %#v, %v", raw["href"], err)
+	}
+	var back link
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Href == nil || *back.Href != *href || back.Base != *base || back.None != nil {
+		t.Errorf("got %+v", back)
+	}
+}
+
+func TestBytesWritten(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	for _, v := range []AMFAny{"hello", 42, 1.5, []AMFAny{"hello", nil}, map[string]AMFAny{"k": true}} {
+		if err := e.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		if e.BytesWritten() != int64(buf.Len()) {
+			t.Errorf("after %#v: BytesWritten %d, buffer holds %d", v, e.BytesWritten(), buf.Len())
+		}
+	}
+	e.Reset()
+	if n := e.BytesWritten(); n != 0 {
+		t.Errorf("after Reset: %d", n)
+	}
+}
+
+func TestEncodeNilInterfaces(t *testing.T) {
+	data := encode(t, []AMFAny{nil, "x", nil})
+	want := []byte{ARRAY_MARKER, 0x07, 0x01, NULL_MARKER, STRING_MARKER, 0x03, 'x', NULL_MARKER}
+	if !bytes.Equal(data, want) {
+		t.Errorf("got % x, want % x", data, want)
+	}
+
+	var err error
+	data = encode(t, map[string]AMFAny{"err": err})
+	var back map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&back); err != nil || !reflect.DeepEqual(back, map[string]AMFAny{"err": nil}) {
+		t.Errorf("nil error: got %#v, %v", back, err)
+	}
+}
+
+func TestEncodeTuple(t *testing.T) {
+	type call struct {
+		Method string
+		Secret string `amf.name:"-"`
+		ID     int
+		flag   bool
+		Flag   bool
+	}
+	data := encode(t, Tuple{&call{"login", "s", 42, true, true}})
+	want := []byte{ARRAY_MARKER, 0x07, 0x01, STRING_MARKER, 0x0b, 'l', 'o', 'g', 'i', 'n', INTEGER_MARKER, 42, TRUE_MARKER}
+	if !bytes.Equal(data, want) {
+		t.Errorf("got % x, want % x", data, want)
+	}
+
+	d := NewDecoder(bytes.NewReader(data))
+	d.PositionalStructs = true
+	var back call
+	if err := d.Decode(&back); err != nil || back != (call{Method: "login", ID: 42, Flag: true}) {
+		t.Errorf("got %+v, %v", back, err)
+	}
+}
+
+func TestPreserveFieldCase(t *testing.T) {
+	type account struct {
+		UserName    string `amf.name:",preserve"`
+		DisplayName string
+	}
+	v := &account{"jdoe", "J. Doe"}
+	for _, tc := range []struct {
+		reserve bool
+		want    map[string]AMFAny
+	}{
+		{false, map[string]AMFAny{"UserName": "jdoe", "displayName": "J. Doe"}},
+		{true, map[string]AMFAny{"UserName": "jdoe", "DisplayName": "J. Doe"}},
+	} {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf, tc.reserve).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		var keys map[string]AMFAny
+		if err := NewDecoder(bytes.NewReader(data)).Decode(&keys); err != nil || !reflect.DeepEqual(keys, tc.want) {
+			t.Errorf("reserve %v: got %#v, %v", tc.reserve, keys, err)
+		}
+		var back account
+		if err := NewDecoder(bytes.NewReader(data)).Decode(&back); err != nil || back != *v {
+			t.Errorf("reserve %v: decoded %+v, %v", tc.reserve, back, err)
+		}
+	}
+}
+
+func TestCommandFrame(t *testing.T) {
+	var stream bytes.Buffer
+	e := NewEncoder(&stream, false)
+	cmd := []AMFAny{"connect", 1.0, map[string]AMFAny{"app": "live", "tcUrl": "rtmp://example.com/live"}, nil}
+	body, err := e.EncodeFrame(cmd...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.Len() != 0 {
+		t.Errorf("EncodeFrame wrote %d bytes to the stream", stream.Len())
+	}
+
+	values, err := NewDecoder(nil).DecodeFrame(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, cmd) {
+		t.Errorf("got %#v, want %#v", values, cmd)
+	}
+}
+
+func TestTextMarshalerRoundTrip(t *testing.T) {
+	type peer struct {
+		Addr net.IP  `amf.name:"addr"`
+		V6   *net.IP `amf.name:"v6"`
+	}
+	v6 := net.ParseIP("2001:db8::1")
+	data := encode(t, &peer{net.ParseIP("192.0.2.7"), &v6})
+
+	var raw map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]AMFAny{"addr": "192.0.2.7", "v6": "2001:db8::1"}; !reflect.DeepEqual(raw, want) {
+		t.Errorf("encoded as %#v", raw)
+	}
+	var back peer
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	if !back.Addr.Equal(net.ParseIP("192.0.2.7")) || back.V6 == nil || !back.V6.Equal(v6) {
+		t.Errorf("got %v, %v", back.Addr, back.V6)
+	}
+}
+
+func TestOnWrite(t *testing.T) {
+	type call struct {
+		marker byte
+		depth  int
+	}
+	var calls []call
+	e := NewEncoder(io.Discard, false)
+	e.OnWrite = func(marker byte, depth int) {
+		calls = append(calls, call{marker, depth})
+	}
+	if err := e.Encode(map[string]AMFAny{"list": []AMFAny{1, "s", map[string]AMFAny{"ok": true}}}); err != nil {
+		t.Fatal(err)
+	}
+	want := []call{
+		{OBJECT_MARKER, 0},
+		{ARRAY_MARKER, 1},
+		{INTEGER_MARKER, 2},
+		{STRING_MARKER, 2},
+		{OBJECT_MARKER, 2},
+		{TRUE_MARKER, 3},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got %v, want %v", calls, want)
+	}
+}
+
+func TestSetReserveStruct(t *testing.T) {
+	type user struct {
+		UserName string
+	}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	e.SealedStructMembers = true
+	for _, reserve := range []bool{false, true, false} {
+		e.SetReserveStruct(reserve)
+		if err := e.Encode(&user{"jdoe"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := NewDecoder(&buf)
+	for _, key := range []string{"userName", "UserName", "userName"} {
+		var m map[string]AMFAny
+		if err := d.Decode(&m); err != nil || !reflect.DeepEqual(m, map[string]AMFAny{key: "jdoe"}) {
+			t.Errorf("got %#v, %v, want key %s", m, err, key)
+		}
+	}
+
+	e.SetReserveStruct(true)
+	e.Reset()
+	if err := e.Encode(&user{"jdoe"}); err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]AMFAny
+	if err := NewDecoder(&buf).Decode(&m); err != nil || m["UserName"] != "jdoe" {
+		t.Errorf("after Reset: got %#v, %v", m, err)
+	}
+}
+
+func TestNilVersusEmpty(t *testing.T) {
+	type lists struct {
+		NilMap     map[string]int `amf.name:"nilMap"`
+		EmptyMap   map[string]int `amf.name:"emptyMap"`
+		NilSlice   []int          `amf.name:"nilSlice"`
+		EmptySlice []int          `amf.name:"emptySlice"`
+		OtherNil   map[string]int `amf.name:"otherNil"`
+	}
+	data := encode(t, &lists{EmptyMap: map[string]int{}, EmptySlice: []int{}})
+
+	var back map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]AMFAny{
+		"nilMap":     nil,
+		"emptyMap":   map[string]AMFAny{},
+		"nilSlice":   nil,
+		"emptySlice": []AMFAny{},
+		"otherNil":   nil,
+	}
+	if !reflect.DeepEqual(back, want) {
+		t.Errorf("got %#v, want %#v", back, want)
+	}
+}
+
+func TestSharedMapAlias(t *testing.T) {
+	type config struct {
+		Primary   map[string]int `amf.name:"primary"`
+		Other     map[string]int `amf.name:"other"`
+		Secondary map[string]int `amf.name:"secondary"`
+		Tags      []string       `amf.name:"tags"`
+		SameTags  []string       `amf.name:"sameTags"`
+	}
+	shared := map[string]int{"n": 1}
+	tags := []string{"a", "b"}
+	data := encode(t, &config{shared, map[string]int{"n": 2}, shared, tags, tags})
+
+	var back config
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Other["n"] != 2 || back.Primary["n"] != 1 {
+		t.Fatalf("got %+v", back)
+	}
+	back.Primary["n"] = 5
+	if back.Secondary["n"] != 5 {
+		t.Errorf("secondary is not an alias of primary: %v", back.Secondary)
+	}
+	if !reflect.DeepEqual(back.SameTags, tags) || &back.Tags[0] != &back.SameTags[0] {
+		t.Errorf("sameTags is not an alias of tags: %v", back.SameTags)
+	}
+}
+
+func TestRawAMFPassthrough(t *testing.T) {
+	data := encode(t, map[string]AMFAny{
+		"name":  "x",
+		"names": []AMFAny{"x", "y", "x"},
+		"blob":  []byte{1, 2, 3},
+		"when":  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		"inner": map[string]AMFAny{"name": 1.5},
+	})
+
+	var raw RawAMF
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if out := encode(t, raw); !bytes.Equal(out, data) {
+		t.Errorf("re-encoded % x, want % x", out, data)
+	}
+}
+
+// Foo is encoded with its type name as class.
+type Foo struct {
+	N int `amf.name:"n"`
+}
+
+func TestUseTypeNameAsClass(t *testing.T) {
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	e.UseTypeNameAsClass = true
+	if err := e.Encode(&Foo{1}); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{OBJECT_MARKER, 0x0b, 0x07, 'F', 'o', 'o', 0x03, 'n', INTEGER_MARKER, 0x01, 0x01}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("got % x, want % x", buf.Bytes(), want)
+	}
+	d := NewDecoder(&buf)
+	var back Foo
+	if err := d.Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	if back.N != 1 || d.traitCache[0].class != "Foo" {
+		t.Errorf("got %+v of class %q", back, d.traitCache[0].class)
+	}
+}
+
+func TestPointerToPrimitive(t *testing.T) {
+	type optional struct {
+		B *bool    `amf.name:"b"`
+		I *int     `amf.name:"i"`
+		U *uint    `amf.name:"u"`
+		F *float64 `amf.name:"f"`
+		S *string  `amf.name:"s"`
+	}
+	b, i, u, f, s := true, -7, uint(7), 2.5, "x"
+	set := optional{&b, &i, &u, &f, &s}
+
+	for _, tc := range []struct {
+		name string
+		v    optional
+	}{
+		{"nil", optional{}},
+		{"set", set},
+	} {
+		var back optional
+		if err := NewDecoder(bytes.NewReader(encode(t, &tc.v))).Decode(&back); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(back, tc.v) {
+			t.Errorf("%s: got %+v", tc.name, back)
+		}
+	}
+
+	// pointers held in map values
+	var nilInt *int
+	m := map[string]AMFAny{"nil": nilInt, "set": &i, "str": &s}
+	var back map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(encode(t, m))).Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]AMFAny{"nil": nil, "set": int32(-7), "str": "x"}; !reflect.DeepEqual(back, want) {
+		t.Errorf("map values: got %#v, want %#v", back, want)
+	}
+	var typed map[string]*int
+	if err := NewDecoder(bytes.NewReader(encode(t, map[string]*int{"nil": nil, "set": &i}))).Decode(&typed); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := typed["nil"]; !ok || p != nil || typed["set"] == nil || *typed["set"] != -7 {
+		t.Errorf("map[string]*int: got %v", typed)
+	}
+}
+
+func TestEncodeStructInInterface(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+	for _, v := range []AMFAny{
+		point{1, 2},
+		map[string]interface{}{"p": point{1, 2}},
+		[]AMFAny{point{1, 2}, point{1, 2}},
+	} {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf, false).Encode(v); err != nil {
+			t.Errorf("%#v: %v", v, err)
+			continue
+		}
+		var back AMFAny
+		if err := NewDecoder(&buf).Decode(&back); err != nil {
+			t.Errorf("%#v: decode: %v", v, err)
+		}
+	}
+
+	var back map[string]point
+	if err := NewDecoder(bytes.NewReader(encode(t, map[string]interface{}{"p": point{1, 2}}))).Decode(&back); err != nil || back["p"] != (point{1, 2}) {
+		t.Errorf("got %+v, %v", back, err)
+	}
+}
+
+func TestIdentityFunc(t *testing.T) {
+	type user struct {
+		ID   int    `amf.name:"id"`
+		Name string `amf.name:"name"`
+	}
+	type thread struct {
+		Author *user `amf.name:"author"`
+		Editor *user `amf.name:"editor"`
+		Other  *user `amf.name:"other"`
+	}
+	v := &thread{&user{1, "a"}, &user{1, "a"}, &user{2, "b"}}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	e.IdentityFunc = func(v reflect.Value) (interface{}, bool) {
+		if u, ok := v.Interface().(*user); ok {
+			return u.ID, true
+		}
+		return nil, false
+	}
+	if err := e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(encode(t, v)); buf.Len() >= n {
+		t.Errorf("identity encoding is %d bytes, plain %d", buf.Len(), n)
+	}
+
+	var back thread
+	if err := NewDecoder(&buf).Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	if back.Author != back.Editor || back.Author == back.Other || *back.Author != (user{1, "a"}) || *back.Other != (user{2, "b"}) {
+		t.Errorf("got %+v, %+v, %+v", back.Author, back.Editor, back.Other)
+	}
+}
+
+func TestEncodeBigInt(t *testing.T) {
+	n, _ := new(big.Int).SetString("1234567890123456789012345678901234567890", 10)
+	data := encode(t, n)
+	if data[0] != STRING_MARKER {
+		t.Errorf("40 digits encoded with marker %#x, want a string", data[0])
+	}
+	back := new(big.Int)
+	if err := NewDecoder(bytes.NewReader(data)).Decode(back); err != nil || back.Cmp(n) != 0 {
+		t.Errorf("got %v, %v, want %v", back, err, n)
+	}
+
+	if data := encode(t, big.NewInt(42)); !bytes.Equal(data, []byte{INTEGER_MARKER, 42}) {
+		t.Errorf("42 encoded as % x", data)
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	type ab struct {
+		A string `amf.name:"a"`
+		B int    `amf.name:"b"`
+	}
+	type ba struct {
+		B int    `amf.name:"b"`
+		A string `amf.name:"a"`
+	}
+	deterministic := func(values ...AMFAny) []byte {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf, false)
+		e.Deterministic = true
+		for _, v := range values {
+			if err := e.Encode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf.Bytes()
+	}
+
+	x, y := deterministic(&ab{"x", 1}, &ab{"x", 1}), deterministic(&ba{1, "x"}, &ba{1, "x"})
+	if !bytes.Equal(x, y) {
+		t.Errorf("field order changed the encoding:\n% x\n% x", x, y)
+	}
+	// no string or traits references: the second value repeats the first
+	if half := len(x) / 2; !bytes.Equal(x[:half], x[half:]) {
+		t.Errorf("second encoding differs: % x", x)
+	}
+}
+
+func TestEncodeValue(t *testing.T) {
+	type item struct {
+		Name string `amf.name:"name"`
+	}
+	for _, v := range []AMFAny{
+		42, "s", []AMFAny{1.5, nil}, map[string]AMFAny{"k": "v"}, &item{"x"}, item{"x"},
+	} {
+		var byValue bytes.Buffer
+		if err := NewEncoder(&byValue, false).EncodeValue(reflect.ValueOf(v)); err != nil {
+			t.Errorf("%#v: %v", v, err)
+			continue
+		}
+		if want := encode(t, v); !bytes.Equal(byValue.Bytes(), want) {
+			t.Errorf("%#v: EncodeValue wrote % x, Encode % x", v, byValue.Bytes(), want)
+		}
+	}
+
+	// an addressable field, reached without boxing it in an interface
+	s := struct{ N int }{7}
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf, false).EncodeValue(reflect.ValueOf(&s).Elem().Field(0)); err != nil || !bytes.Equal(buf.Bytes(), encode(t, 7)) {
+		t.Errorf("field: got % x, %v", buf.Bytes(), err)
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestEncodeToCount(t *testing.T) {
+	v := map[string]AMFAny{"list": []AMFAny{"a", "a", 1.5}, "blob": []byte{1, 2, 3}}
+
+	var buf bytes.Buffer
+	cw := &countingWriter{w: &buf}
+	n, err := EncodeTo(cw, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != cw.n || n != int64(buf.Len()) {
+		t.Errorf("returned %d, writer saw %d", n, cw.n)
+	}
+
+	// through a buffered writer, which EncodeTo flushes
+	buf.Reset()
+	cw = &countingWriter{w: &buf}
+	n, err = EncodeTo(bufio.NewWriter(cw), v)
+	if err != nil || n != cw.n || n == 0 {
+		t.Errorf("buffered: returned %d, %v, writer saw %d", n, err, cw.n)
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	in := `{"name": "x", "n": 42, "neg": -3, "f": 1.5, "huge": 4294967296, "list": [1, "a", null, true], "obj": {"k": "v"}}`
+	var buf bytes.Buffer
+	if err := EncodeJSON(strings.NewReader(in), &buf); err != nil {
+		t.Fatal(err)
+	}
+	var v AMFAny
+	if err := NewDecoder(&buf).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]AMFAny{
+		"name": "x",
+		"n":    int32(42),
+		"neg":  int32(-3),
+		"f":    1.5,
+		"huge": 4294967296.0,
+		"list": []AMFAny{int32(1), "a", nil, true},
+		"obj":  map[string]AMFAny{"k": "v"},
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("got %#v, want %#v", v, want)
+	}
+
+	if err := EncodeJSON(strings.NewReader(`{"a":`), io.Discard); err == nil {
+		t.Error("truncated JSON encoded")
+	}
+}
+
+func TestReferenceTablesRoundTrip(t *testing.T) {
+	data := encode(t, map[string]AMFAny{
+		"kind":  "user",
+		"items": []AMFAny{"user", "admin", map[string]AMFAny{"kind": "admin"}},
+	})
+
+	d := NewDecoder(bytes.NewReader(data))
+	var v AMFAny
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	if err := e.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	ds, es := d.StringTable(), e.StringTable()
+	if len(ds) != len(es) || len(ds) != 4 {
+		t.Errorf("decoder strings %q, encoder strings %q", ds, es)
+	}
+	if d.ObjectCount() != e.ObjectCount() || d.ObjectCount() != 3 {
+		t.Errorf("decoder objects %d, encoder objects %d", d.ObjectCount(), e.ObjectCount())
+	}
+}
+
+func TestEncodeLengthPrefixed(t *testing.T) {
+	v := []AMFAny{"play", 1, map[string]AMFAny{"stream": "live"}}
+	body := encode(t, v)
+	for _, tc := range []struct {
+		order binary.ByteOrder
+		size  int
+	}{
+		{binary.BigEndian, 2},
+		{binary.BigEndian, 4},
+		{binary.LittleEndian, 2},
+		{binary.LittleEndian, 4},
+	} {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf, false).EncodeLengthPrefixed(v, tc.order, tc.size); err != nil {
+			t.Fatal(err)
+		}
+		out := buf.Bytes()
+		var n uint64
+		if tc.size == 2 {
+			n = uint64(tc.order.Uint16(out))
+		} else {
+			n = uint64(tc.order.Uint32(out))
+		}
+		if n != uint64(len(body)) || !bytes.Equal(out[tc.size:], body) {
+			t.Errorf("%v %d: prefix %d, body % x, want %d bytes % x", tc.order, tc.size, n, out[tc.size:], len(body), body)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := NewEncoder(&buf, false).EncodeLengthPrefixed(make([]byte, 70000), binary.BigEndian, 2)
+	if err == nil || buf.Len() != 0 {
+		t.Errorf("oversized body: got %v, wrote %d bytes", err, buf.Len())
+	}
+	if err := NewEncoder(&buf, false).EncodeLengthPrefixed(v, binary.BigEndian, 3); err == nil {
+		t.Error("3 byte prefix accepted")
+	}
+}
+
+func TestEncodedSize(t *testing.T) {
+	shared := map[string]AMFAny{"k": "v"}
+	type named struct {
+		FirstName string
+	}
+	for _, v := range []AMFAny{
+		nil, 42, 1 << 40, "hello",
+		[]AMFAny{"a", "a", shared, shared}, // references
+		&named{"x"},
+		[]byte{1, 2, 3},
+	} {
+		for _, reserve := range []bool{false, true} {
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf, reserve).Encode(v); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := EncodedSize(v, reserve); err != nil || n != buf.Len() {
+				t.Errorf("%#v, reserve %v: EncodedSize %d, %v, encoding is %d bytes", v, reserve, n, err, buf.Len())
+			}
+		}
+	}
+}
+
+// codeError is an error with a text form of its own.
+type codeError struct{ code int }
+
+func (e *codeError) Error() string { return "error " + strconv.Itoa(e.code) }
+
+func (e *codeError) MarshalText() ([]byte, error) { return []byte("E" + strconv.Itoa(e.code)), nil }
+
+func TestEncodeErrors(t *testing.T) {
+	data := encode(t, []AMFAny{errors.New("boom"), nil, &codeError{7}})
+	var v []AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if want := []AMFAny{"boom", nil, "E7"}; !reflect.DeepEqual(v, want) {
+		t.Errorf("got %#v, want %#v", v, want)
+	}
+}
+
+func TestEncodeSyncMap(t *testing.T) {
+	var attrs sync.Map
+	attrs.Store("status", "ok")
+	attrs.Store("code", 200)
+	attrs.Store("tags", []AMFAny{"a"})
+
+	var back map[string]interface{}
+	if err := NewDecoder(bytes.NewReader(encode(t, &attrs))).Decode(&back); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"status": "ok", "code": int32(200), "tags": []AMFAny{"a"}}; !reflect.DeepEqual(back, want) {
+		t.Errorf("got %#v, want %#v", back, want)
+	}
+
+	// shared like any map
+	data := encode(t, []AMFAny{&attrs, &attrs})
+	var list []map[string]interface{}
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&list); err != nil || len(list) != 2 || reflect.ValueOf(list[0]).Pointer() != reflect.ValueOf(list[1]).Pointer() {
+		t.Errorf("shared: got %#v, %v", list, err)
+	}
+
+	var bad sync.Map
+	bad.Store(1, "x")
+	if err := NewEncoder(io.Discard, false).Encode(&bad); err == nil || err.Error() != "sync.Map key must be string" {
+		t.Errorf("int key: got %v", err)
+	}
+}
+
+func TestStructInfoCacheConcurrent(t *testing.T) {
+	type record struct {
+		ID   int    `amf.name:"id"`
+		Name string `amf.name:"name"`
+	}
+	want := encode(t, &record{1, "x"})
+	var wg sync.WaitGroup
+	infos := make([]*structInfo, 8)
+	for i := range infos {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf, false).Encode(&record{1, "x"}); err != nil || !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("goroutine %d: got % x, %v", i, buf.Bytes(), err)
+			}
+			infos[i] = cachedStructInfo(reflect.TypeOf(record{}))
+		}(i)
+	}
+	wg.Wait()
+	for _, si := range infos[1:] {
+		if si != infos[0] {
+			t.Error("struct info computed more than once per type")
+		}
+	}
+}
+
+func TestSortMapKeys(t *testing.T) {
+	m := map[string]AMFAny{}
+	for i := 0; i < 20; i++ {
+		m["k"+strconv.Itoa(i)] = i
+	}
+	sorted := func() []byte {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf, false)
+		e.SortMapKeys = true
+		if err := e.Encode(m); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	first := sorted()
+	for i := 0; i < 10; i++ {
+		if b := sorted(); !bytes.Equal(b, first) {
+			t.Fatalf("encodings differ:\n% x\n% x", first, b)
+		}
+	}
+	// k0, k1, k10, k11, ...: lexicographic, not numeric
+	prefix := []byte{OBJECT_MARKER, 0x0b, 0x01, 0x05, 'k', '0', INTEGER_MARKER, 0, 0x05, 'k', '1', INTEGER_MARKER, 1, 0x07, 'k', '1', '0'}
+	if !bytes.HasPrefix(first, prefix) {
+		t.Errorf("got % x, want prefix % x", first, prefix)
+	}
+}
+
+func TestAllNumbersAsDouble(t *testing.T) {
+	for _, tc := range []struct {
+		v    AMFAny
+		want float64
+	}{
+		{42, 42},
+		{uint8(7), 7},
+		{int64(-3), -3},
+		{big.NewInt(5), 5},
+	} {
+		if data := encode(t, tc.v); data[0] != INTEGER_MARKER {
+			t.Errorf("%v: marker %#x without the option", tc.v, data[0])
+		}
+
+		var buf bytes.Buffer
+		e := NewEncoder(&buf, false)
+		e.AllNumbersAsDouble = true
+		if err := e.Encode(tc.v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Bytes()[0] != DOUBLE_MARKER {
+			t.Errorf("%v: marker %#x with the option", tc.v, buf.Bytes()[0])
+		}
+		var back AMFAny
+		if err := NewDecoder(&buf).Decode(&back); err != nil || back != tc.want {
+			t.Errorf("%v: decoded %#v, %v", tc.v, back, err)
+		}
+	}
+}
+
+func TestFlattenHeaders(t *testing.T) {
+	h := http.Header{"Accept": {"text/plain"}, "Via": {"a", "b"}}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	e.FlattenSingleElementSlices = true
+	if err := e.Encode(h); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	var raw map[string]AMFAny
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]AMFAny{"Accept": "text/plain", "Via": []AMFAny{"a", "b"}}; !reflect.DeepEqual(raw, want) {
+		t.Errorf("flattened: got %#v, want %#v", raw, want)
+	}
+	var back http.Header
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&back); err != nil || !reflect.DeepEqual(back, h) {
+		t.Errorf("decoded %#v, %v, want %#v", back, err, h)
+	}
+
+	// without the option every value stays an array
+	if err := NewDecoder(bytes.NewReader(encode(t, h))).Decode(&raw); err != nil || !reflect.DeepEqual(raw["Accept"], []AMFAny{"text/plain"}) {
+		t.Errorf("unflattened: got %#v, %v", raw, err)
+	}
+}
+
+func TestSealedStructMembers(t *testing.T) {
+	type point struct {
+		X int32 `amf.name:"x"`
+		Y int32 `amf.name:"y"`
+	}
+	in := []point{{1, 2}, {3, 4}}
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, false)
+	e.SealedStructMembers = true
+	if err := e.Encode(in); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{ARRAY_MARKER, 0x05, 0x01,
+		// two sealed members, anonymous class, then the member names
+		OBJECT_MARKER, 0x23, 0x01, 0x03, 'x', 0x03, 'y', INTEGER_MARKER, 0x01, INTEGER_MARKER, 0x02,
+		// a reference to the first traits
+		OBJECT_MARKER, 0x01, INTEGER_MARKER, 0x03, INTEGER_MARKER, 0x04}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("got % x, want % x", buf.Bytes(), want)
+	}
+
+	var out []point
+	if err := NewDecoder(&buf).Decode(&out); err != nil || !reflect.DeepEqual(out, in) {
+		t.Errorf("got %#v, %v, want %#v", out, err, in)
+	}
+}